@@ -1,3 +1,11 @@
 package cmd
 
-const FLAG_HOME = "home"
+const (
+	FLAG_HOME       = "home"
+	FLAG_NETWORK    = "network"
+	FLAG_TX         = "tx"
+	FLAG_FROM_BLOCK = "from-block"
+	FLAG_TO_BLOCK   = "to-block"
+	FLAG_DRY_RUN    = "dry-run"
+	FLAG_ALL        = "all"
+)
@@ -1,9 +1,12 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/JackalLabs/mulberry/relay"
 	"github.com/spf13/cobra"
@@ -17,7 +20,7 @@ func RootCMD() *cobra.Command {
 EVM chains to the Jackal network ot bridge storage capabilities cross-chain.`,
 	}
 
-	r.AddCommand(StartCMD(), WalletCMD())
+	r.AddCommand(StartCMD(), ReplayCMD(), DeadLetterCMD(), WalletCMD())
 
 	r.PersistentFlags().String(FLAG_HOME, "$HOME/.mulberry", "where the mulberry config can be found")
 
@@ -41,10 +44,210 @@ func StartCMD() *cobra.Command {
 
 			log.Print("Starting relay...")
 
-			return a.Start()
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			return a.Start(ctx)
+		},
+	}
+
+	return r
+}
+
+func ReplayCMD() *cobra.Command {
+	r := &cobra.Command{
+		Use:   "replay",
+		Short: "Relays the bridge events of a specific EVM transaction or block range",
+		Example: `mulberry replay --network 1 --tx 0x...
+mulberry replay --network Ethereum --from-block 19000000 --to-block 19000100 --dry-run`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			home, err := getHome(cmd)
+			if err != nil {
+				return err
+			}
+
+			network, err := cmd.Flags().GetString(FLAG_NETWORK)
+			if err != nil {
+				return err
+			}
+			txHash, err := cmd.Flags().GetString(FLAG_TX)
+			if err != nil {
+				return err
+			}
+			fromBlock, err := cmd.Flags().GetUint64(FLAG_FROM_BLOCK)
+			if err != nil {
+				return err
+			}
+			toBlock, err := cmd.Flags().GetUint64(FLAG_TO_BLOCK)
+			if err != nil {
+				return err
+			}
+			dryRun, err := cmd.Flags().GetBool(FLAG_DRY_RUN)
+			if err != nil {
+				return err
+			}
+
+			if len(txHash) > 0 && (fromBlock > 0 || toBlock > 0) {
+				return fmt.Errorf("--%s cannot be used with a block range", FLAG_TX)
+			}
+			if len(txHash) == 0 && fromBlock == 0 {
+				return fmt.Errorf("either --%s or --%s is required", FLAG_TX, FLAG_FROM_BLOCK)
+			}
+			if toBlock == 0 {
+				toBlock = fromBlock
+			}
+
+			a, err := relay.MakeApp(home)
+			if err != nil {
+				return err
+			}
+
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			return a.Replay(ctx, relay.ReplayOptions{
+				Network:   network,
+				TxHash:    txHash,
+				FromBlock: fromBlock,
+				ToBlock:   toBlock,
+				DryRun:    dryRun,
+			})
 		},
 	}
 
+	r.Flags().String(FLAG_NETWORK, "", "name or chain id of the network to replay from")
+	r.Flags().String(FLAG_TX, "", "hash of the transaction to replay")
+	r.Flags().Uint64(FLAG_FROM_BLOCK, 0, "first block of the range to replay")
+	r.Flags().Uint64(FLAG_TO_BLOCK, 0, "last block of the range to replay, defaults to --from-block")
+	r.Flags().Bool(FLAG_DRY_RUN, false, "print the messages instead of broadcasting them")
+	_ = r.MarkFlagRequired(FLAG_NETWORK)
+
+	return r
+}
+
+func DeadLetterCMD() *cobra.Command {
+	r := &cobra.Command{
+		Use:     "deadletter",
+		Aliases: []string{"dl"},
+		Short:   "Commands to manage events that failed to relay",
+	}
+	r.AddCommand(DeadLetterListCMD(), DeadLetterInspectCMD(), DeadLetterRetryCMD())
+
+	return r
+}
+
+func DeadLetterListCMD() *cobra.Command {
+	r := &cobra.Command{
+		Use:   "list",
+		Short: "Lists the stored dead letters",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			home, err := getHome(cmd)
+			if err != nil {
+				return err
+			}
+
+			a, err := relay.MakeApp(home)
+			if err != nil {
+				return err
+			}
+
+			letters, err := a.DeadLetters()
+			if err != nil {
+				return err
+			}
+
+			if len(letters) == 0 {
+				fmt.Println("No dead letters")
+				return nil
+			}
+			for _, d := range letters {
+				fmt.Printf("%s | %s | block %d | %d attempts | %s\n", d.ID, d.Network, d.Log.BlockNumber, d.Attempts, d.Error)
+			}
+
+			return nil
+		},
+	}
+
+	return r
+}
+
+func DeadLetterInspectCMD() *cobra.Command {
+	r := &cobra.Command{
+		Use:   "inspect [id]",
+		Short: "Prints a dead letter with its raw log",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			home, err := getHome(cmd)
+			if err != nil {
+				return err
+			}
+
+			a, err := relay.MakeApp(home)
+			if err != nil {
+				return err
+			}
+
+			d, err := a.DeadLetter(args[0])
+			if err != nil {
+				return err
+			}
+
+			data, err := json.MarshalIndent(d, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(data))
+
+			return nil
+		},
+	}
+
+	return r
+}
+
+func DeadLetterRetryCMD() *cobra.Command {
+	r := &cobra.Command{
+		Use:   "retry [id...]",
+		Short: "Relays dead letters again, removing the ones that go through",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			home, err := getHome(cmd)
+			if err != nil {
+				return err
+			}
+
+			all, err := cmd.Flags().GetBool(FLAG_ALL)
+			if err != nil {
+				return err
+			}
+			if all == (len(args) > 0) {
+				return fmt.Errorf("pass either dead letter ids or --%s", FLAG_ALL)
+			}
+
+			a, err := relay.MakeApp(home)
+			if err != nil {
+				return err
+			}
+
+			ids := args
+			if all {
+				letters, err := a.DeadLetters()
+				if err != nil {
+					return err
+				}
+				for _, d := range letters {
+					ids = append(ids, d.ID)
+				}
+			}
+
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			return a.RetryDeadLetters(ctx, ids)
+		},
+	}
+
+	r.Flags().Bool(FLAG_ALL, false, "retry every stored dead letter")
+
 	return r
 }
 
@@ -1,6 +1,10 @@
 package config
 
 import (
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
 	_ "github.com/mitchellh/mapstructure"
 	"gopkg.in/yaml.v3"
 )
@@ -12,7 +16,48 @@ type Config struct {
 }
 
 type MulberrySettings struct {
-	CastPath string `yaml:"cast_path" mapstructure:"cast_path"`
+	// ShutdownTimeout is the number of seconds in-flight messages get to finish on shutdown, defaults to 30
+	ShutdownTimeout uint64 `yaml:"shutdown_timeout,omitempty" mapstructure:"shutdown_timeout"`
+	// PostTimeout is the number of seconds a Jackal message gets to be executed before it is given up on, defaults to 300
+	PostTimeout uint64 `yaml:"post_timeout,omitempty" mapstructure:"post_timeout"`
+	// PaymentCheck is what happens to paid events whose EVM payment doesn't cover the Jackal cost: "reject" (default), "flag" or "off"
+	PaymentCheck string `yaml:"payment_check,omitempty" mapstructure:"payment_check"`
+	// PaymentMargin is the share of the Jackal cost the EVM payment must cover on top of it, 0.1 asks for 110%
+	PaymentMargin float64 `yaml:"payment_margin,omitempty" mapstructure:"payment_margin"`
+	// Relays are the EVM addresses of every relay sharing the work, this one included. Empty relays everything alone
+	Relays []string `yaml:"relays,omitempty" mapstructure:"relays"`
+	// TakeoverTimeout is the number of seconds a relay waits per relay ahead of it before taking over a message, defaults to 1200
+	TakeoverTimeout uint64 `yaml:"takeover_timeout,omitempty" mapstructure:"takeover_timeout"`
+}
+
+const (
+	PaymentCheckReject = "reject"
+	PaymentCheckFlag   = "flag"
+	PaymentCheckOff    = "off"
+)
+
+// Validate checks the relay settings
+func (m MulberrySettings) Validate() error {
+	switch m.PaymentCheck {
+	case "", PaymentCheckReject, PaymentCheckFlag, PaymentCheckOff:
+	default:
+		return fmt.Errorf("unknown payment check %q", m.PaymentCheck)
+	}
+	if m.PaymentMargin < 0 {
+		return fmt.Errorf("payment margin %f is negative", m.PaymentMargin)
+	}
+	seen := make(map[string]bool)
+	for _, r := range m.Relays {
+		if !common.IsHexAddress(r) {
+			return fmt.Errorf("relay %q is not an EVM address", r)
+		}
+		address := strings.ToLower(r)
+		if seen[address] {
+			return fmt.Errorf("relay %s is listed twice", r)
+		}
+		seen[address] = true
+	}
+	return nil
 }
 
 type JackalConfig struct {
@@ -20,6 +65,68 @@ type JackalConfig struct {
 	GRPC     string `yaml:"grpc" mapstructure:"grpc"`
 	SeedFile string `yaml:"seed_file" mapstructure:"seed_file"`
 	Contract string `yaml:"contract" mapstructure:"contract"`
+	// BatchSize is the max number of messages per Jackal transaction, defaults to 10
+	BatchSize int `yaml:"batch_size,omitempty" mapstructure:"batch_size"`
+	// FlushInterval is the number of milliseconds between Jackal transactions, defaults to 1000
+	FlushInterval uint64 `yaml:"flush_interval,omitempty" mapstructure:"flush_interval"`
+	// MaxQueueDepth is the max number of messages waiting for a Jackal transaction, defaults to 1000
+	MaxQueueDepth int `yaml:"max_queue_depth,omitempty" mapstructure:"max_queue_depth"`
+	// Price configures where the JKL price used to charge for storage comes from
+	Price PriceConfig `yaml:"price,omitempty" mapstructure:"price"`
+	// ParamsInterval is the number of seconds between reads of the storage pricing from Jackal, defaults to 3600
+	ParamsInterval uint64 `yaml:"params_interval,omitempty" mapstructure:"params_interval"`
+	// Fees is what the relay charges on top of the storage cost
+	Fees FeeConfig `yaml:"fees,omitempty" mapstructure:"fees"`
+}
+
+// FeeConfig is the fee policy applied to paid messages
+type FeeConfig struct {
+	// Markup multiplies the storage cost, defaults to 1.2
+	Markup float64 `yaml:"markup,omitempty" mapstructure:"markup"`
+	// FlatFee is a number of ujkl added to every paid message
+	FlatFee int64 `yaml:"flat_fee,omitempty" mapstructure:"flat_fee"`
+}
+
+// Validate checks the fee policy
+func (f FeeConfig) Validate() error {
+	if f.Markup < 0 {
+		return fmt.Errorf("markup %f is negative", f.Markup)
+	}
+	if f.Markup > 0 && f.Markup < 1 {
+		return fmt.Errorf("markup %f would charge less than the storage cost", f.Markup)
+	}
+	if f.FlatFee < 0 {
+		return fmt.Errorf("flat fee %d is negative", f.FlatFee)
+	}
+	return nil
+}
+
+// PriceConfig lists the JKL price sources, their median is used. CoinGecko is used alone when nothing is set.
+type PriceConfig struct {
+	CoinGecko bool `yaml:"coingecko,omitempty" mapstructure:"coingecko"`
+	// CoinGeckoURL overrides the CoinGecko simple price endpoint
+	CoinGeckoURL string `yaml:"coingecko_url,omitempty" mapstructure:"coingecko_url"`
+	// Static is a fixed JKL price in USD, 0 leaves it out
+	Static float64 `yaml:"static,omitempty" mapstructure:"static"`
+	// Feeds are http(s) URLs or json files (relative to the home directory) serving {"price": 0.3, "time": "2024-01-01T00:00:00Z"}
+	Feeds []string `yaml:"feeds,omitempty" mapstructure:"feeds"`
+	// MaxAge is the number of seconds a price is trusted for, paid messages stop being relayed past it. Defaults to 1800
+	MaxAge uint64 `yaml:"max_age,omitempty" mapstructure:"max_age"`
+	// Interval is the number of seconds between price updates, defaults to 600
+	Interval uint64 `yaml:"interval,omitempty" mapstructure:"interval"`
+}
+
+// Validate checks the price sources
+func (p PriceConfig) Validate() error {
+	if p.Static < 0 {
+		return fmt.Errorf("static price %f is negative", p.Static)
+	}
+	for _, feed := range p.Feeds {
+		if len(strings.TrimSpace(feed)) == 0 {
+			return fmt.Errorf("empty price feed")
+		}
+	}
+	return nil
 }
 
 type NetworkConfig struct {
@@ -29,11 +136,133 @@ type NetworkConfig struct {
 	Contract string `yaml:"contract" mapstructure:"contract"`
 	ChainID  uint64 `yaml:"chain_id" mapstructure:"chain_id"`
 	Finality uint64 `yaml:"finality" mapstructure:"finality"`
+	// RPCEndpoints and WSEndpoints are fallbacks tried in order after RPC and WS, the healthiest endpoint is always used first
+	RPCEndpoints []string `yaml:"rpc_endpoints,omitempty" mapstructure:"rpc_endpoints"`
+	WSEndpoints  []string `yaml:"ws_endpoints,omitempty" mapstructure:"ws_endpoints"`
+	// Quorum is the number of RPC endpoints that must report a log before it is relayed, 0 or 1 trusts a single endpoint
+	Quorum int `yaml:"quorum,omitempty" mapstructure:"quorum"`
+	// FinalityMode is "confirmations" (default) to wait for Finality blocks on top of a log, or "safe"/"finalized" to wait for that block tag to pass it
+	FinalityMode string `yaml:"finality_mode,omitempty" mapstructure:"finality_mode"`
+	// BackfillRange is the max number of blocks requested per eth_getLogs call when catching up, defaults to 1000
+	BackfillRange uint64 `yaml:"backfill_range,omitempty" mapstructure:"backfill_range"`
+	// LogSource selects how logs are received, either "ws" (default) to subscribe over WS or "http" to poll eth_getLogs over RPC
+	LogSource string `yaml:"log_source,omitempty" mapstructure:"log_source"`
+	// Workers is the number of logs relayed at once on this network, defaults to 8
+	Workers int `yaml:"workers,omitempty" mapstructure:"workers"`
+	// MaxPending is the number of logs that can be queued or in flight before new logs wait, defaults to 1000
+	MaxPending int `yaml:"max_pending,omitempty" mapstructure:"max_pending"`
+	// PollInterval is the number of seconds between eth_getLogs calls when LogSource is "http", defaults to 12
+	PollInterval uint64 `yaml:"poll_interval,omitempty" mapstructure:"poll_interval"`
+	// ContractABI is the ABI of Contract, like the ABI of a ContractConfig. Defaults to DefaultABIVersion
+	ContractABI string `yaml:"contract_abi,omitempty" mapstructure:"contract_abi"`
+	// Contracts are more bridge contracts to watch next to Contract, each decoded with its own ABI
+	Contracts []ContractConfig `yaml:"contracts,omitempty" mapstructure:"contracts"`
+	// MaxTxFee is the most a relay transaction can spend on fees, in gwei. 0 doesn't cap it
+	MaxTxFee uint64 `yaml:"max_tx_fee,omitempty" mapstructure:"max_tx_fee"`
+	// TxBumpInterval is the number of seconds before a transaction that was not mined is replaced with higher fees, defaults to 60
+	TxBumpInterval uint64 `yaml:"tx_bump_interval,omitempty" mapstructure:"tx_bump_interval"`
+	// FinishBatchSize is the number of finishMessage calls sent together through Multicall, 0 or 1 sends each on its own
+	FinishBatchSize int `yaml:"finish_batch_size,omitempty" mapstructure:"finish_batch_size"`
+	// FinishBatchInterval is the most seconds a finishMessage call waits for its batch to fill, defaults to 30
+	FinishBatchInterval uint64 `yaml:"finish_batch_interval,omitempty" mapstructure:"finish_batch_interval"`
+	// Multicall is a Multicall3 compatible contract only the relay can call, batches are sent through it.
+	// It has no default, the public Multicall3 would let anyone finish messages once it is a relay of the bridge.
+	Multicall string `yaml:"multicall,omitempty" mapstructure:"multicall"`
+}
+
+// ContractConfig is a contract to relay events from
+type ContractConfig struct {
+	Address string `yaml:"address" mapstructure:"address"`
+	// ABI is an ABI version shipped with the relay (like "v1") or the path to an ABI json file, defaults to DefaultABIVersion
+	ABI string `yaml:"abi,omitempty" mapstructure:"abi"`
+}
+
+// DefaultABIVersion is the ABI of the current bridge contract, used for Contract and contracts that don't set one
+const DefaultABIVersion = "v1"
+
+// AllContracts returns Contract and Contracts with their ABI set
+func (n NetworkConfig) AllContracts() []ContractConfig {
+	var contracts []ContractConfig
+	if len(n.Contract) > 0 {
+		contracts = append(contracts, ContractConfig{Address: n.Contract, ABI: n.ContractABI})
+	}
+	contracts = append(contracts, n.Contracts...)
+	for i := range contracts {
+		if len(contracts[i].ABI) == 0 {
+			contracts[i].ABI = DefaultABIVersion
+		}
+	}
+	return contracts
+}
+
+const (
+	LogSourceWS   = "ws"
+	LogSourceHTTP = "http"
+)
+
+const (
+	FinalityConfirmations = "confirmations"
+	FinalitySafe          = "safe"
+	FinalityFinalized     = "finalized"
+)
+
+// Validate checks the optional settings of a network
+func (n NetworkConfig) Validate() error {
+	switch n.LogSource {
+	case "", LogSourceWS:
+		if len(n.WS) == 0 && len(n.WSEndpoints) == 0 {
+			return fmt.Errorf("%s: no ws endpoint, set log_source to %q to poll over rpc", n.Name, LogSourceHTTP)
+		}
+	case LogSourceHTTP:
+	default:
+		return fmt.Errorf("%s: unknown log source %q", n.Name, n.LogSource)
+	}
+
+	rpcs := len(n.RPCEndpoints)
+	if len(n.RPC) > 0 {
+		rpcs++
+	}
+	if rpcs == 0 {
+		return fmt.Errorf("%s: no rpc endpoint", n.Name)
+	}
+	if n.Quorum > rpcs {
+		return fmt.Errorf("%s: quorum of %d needs at least as many rpc endpoints, have %d", n.Name, n.Quorum, rpcs)
+	}
+
+	switch n.FinalityMode {
+	case "", FinalityConfirmations, FinalitySafe, FinalityFinalized:
+	default:
+		return fmt.Errorf("%s: unknown finality mode %q", n.Name, n.FinalityMode)
+	}
+
+	if n.FinishBatchSize < 0 {
+		return fmt.Errorf("%s: finish batch size %d is negative", n.Name, n.FinishBatchSize)
+	}
+	if n.FinishBatchSize > 1 && len(n.Multicall) == 0 {
+		return fmt.Errorf("%s: finish batch size %d needs a multicall contract to send batches through", n.Name, n.FinishBatchSize)
+	}
+	if len(n.Multicall) > 0 && !common.IsHexAddress(n.Multicall) {
+		return fmt.Errorf("%s: multicall %q is not an EVM address", n.Name, n.Multicall)
+	}
+
+	contracts := n.AllContracts()
+	if len(contracts) == 0 {
+		return fmt.Errorf("%s: no contract", n.Name)
+	}
+	seen := make(map[string]bool)
+	for _, c := range contracts {
+		address := strings.ToLower(c.Address)
+		if seen[address] {
+			return fmt.Errorf("%s: contract %s is listed twice", n.Name, c.Address)
+		}
+		seen[address] = true
+	}
+
+	return nil
 }
 
 func DefaultConfig() Config {
 	return Config{
-		MulberrySettings: MulberrySettings{CastPath: "/bin/cast"},
 		JackalConfig: JackalConfig{
 			RPC:      "https://testnet-rpc.jackalprotocol.com:443",
 			GRPC:     "jackal-testnet-grpc.polkachu.com:17590",
@@ -95,7 +324,6 @@ func DefaultConfig() Config {
 
 func DefaultMainnetConfig() Config {
 	return Config{
-		MulberrySettings: MulberrySettings{CastPath: "/bin/cast"},
 		JackalConfig: JackalConfig{
 			RPC:      "https://jackal-storage-rpc.brocha.in:443",
 			GRPC:     "https://jackal-storage-grpc.brocha.in:443",
@@ -0,0 +1,30 @@
+// SPDX-License-Identifier: MIT
+pragma solidity ^0.8.26;
+
+import {Ownable} from "@openzeppelin/contracts/access/Ownable.sol";
+
+// Multicall3 aggregate3 that only its owner, the relay, can call.
+// Add it as a relay of the bridge so the relay can send its finishMessage calls in batches.
+contract RelayMulticall is Ownable {
+    struct Call3 {
+        address target;
+        bool allowFailure;
+        bytes callData;
+    }
+
+    struct Result {
+        bool success;
+        bytes returnData;
+    }
+
+    constructor() Ownable(msg.sender) {}
+
+    function aggregate3(Call3[] calldata calls) public payable onlyOwner returns (Result[] memory returnData) {
+        returnData = new Result[](calls.length);
+        for (uint256 i = 0; i < calls.length; i++) {
+            (bool success, bytes memory ret) = calls[i].target.call(calls[i].callData);
+            require(success || calls[i].allowFailure, "call failed");
+            returnData[i] = Result(success, ret);
+        }
+    }
+}
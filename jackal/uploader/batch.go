@@ -0,0 +1,329 @@
+package uploader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cosmos/cosmos-sdk/crypto/keys/secp256k1"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/cosmos/cosmos-sdk/types/tx/signing"
+	walletTypes "github.com/desmos-labs/cosmos-go-wallet/types"
+	"github.com/desmos-labs/cosmos-go-wallet/wallet"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// ErrSimulation is returned for messages the chain rejects when simulating them
+	ErrSimulation = errors.New("simulation failed")
+	// ErrTxFailed matches every *TxError
+	ErrTxFailed = errors.New("transaction failed")
+)
+
+const (
+	// settleTimeout is how long a transaction whose broadcast failed is looked for before its outcome is called unknown
+	settleTimeout = 2 * time.Minute
+	lookupTimeout = 30 * time.Second
+)
+
+// wasmErrorPattern finds the contract error in the raw log of a failed MsgExecuteContract,
+// like "failed to execute message; message index: 0: Unauthorized: execute wasm contract failed"
+var wasmErrorPattern = regexp.MustCompile(`message index: \d+: (.+): execute wasm contract failed`)
+
+// TxError is returned for messages whose transaction was included with a non-zero code
+type TxError struct {
+	TxHash    string
+	Code      uint32
+	Codespace string
+	RawLog    string
+	// WasmError is the error returned by the contract, empty if the failure did not come from a contract
+	WasmError string
+}
+
+func newTxError(res *sdk.TxResponse) *TxError {
+	e := TxError{
+		TxHash:    res.TxHash,
+		Code:      res.Code,
+		Codespace: res.Codespace,
+		RawLog:    res.RawLog,
+	}
+	match := wasmErrorPattern.FindStringSubmatch(res.RawLog)
+	if len(match) > 1 {
+		e.WasmError = match[1]
+	}
+	return &e
+}
+
+func (e *TxError) Error() string {
+	if len(e.WasmError) > 0 {
+		return fmt.Sprintf("tx %s failed with code %d in %s: %s", e.TxHash, e.Code, e.Codespace, e.WasmError)
+	}
+	return fmt.Sprintf("tx %s failed with code %d in %s | %s", e.TxHash, e.Code, e.Codespace, e.RawLog)
+}
+
+func (e *TxError) Is(target error) bool {
+	return target == ErrTxFailed
+}
+
+// txClient simulates and broadcasts transactions for the queue
+type txClient interface {
+	// Simulate runs the messages against the current chain state, returning the gas to use for them.
+	// Errors wrapping ErrSimulation come from the messages themselves, other errors mean the node could not be asked.
+	Simulate(msgs ...sdk.Msg) (uint64, error)
+	// Broadcast posts the messages in a single transaction and waits for it to be included,
+	// calling signed with the transaction hash right before it is sent
+	Broadcast(gas uint64, signed func(txHash string), msgs ...sdk.Msg) (*sdk.TxResponse, error)
+	// Lookup returns the result of an included transaction, or nil if the chain doesn't know it
+	Lookup(ctx context.Context, txHash string) (*sdk.TxResponse, error)
+	// Pending reports if a transaction waits in the mempool of the node, or might because the mempool is too large to read
+	Pending(ctx context.Context, txHash string) (bool, error)
+}
+
+// walletClient is the txClient of a Jackal wallet
+type walletClient struct {
+	w *wallet.Wallet
+}
+
+func (c walletClient) Simulate(msgs ...sdk.Msg) (uint64, error) {
+	w := c.w
+	account, err := w.Client.GetAccount(w.AccAddress())
+	if err != nil {
+		return 0, fmt.Errorf("cannot get account | %w", err)
+	}
+
+	builder := w.TxConfig.NewTxBuilder()
+	err = builder.SetMsgs(msgs...)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrSimulation, err.Error())
+	}
+
+	// the ante handler only needs a placeholder signature with the right sequence while simulating
+	err = builder.SetSignatures(signing.SignatureV2{
+		PubKey: &secp256k1.PubKey{},
+		Data: &signing.SingleSignatureData{
+			SignMode: signing.SignMode_SIGN_MODE_DIRECT,
+		},
+		Sequence: account.GetSequence(),
+	})
+	if err != nil {
+		return 0, err
+	}
+	builder.SetGasLimit(200_000)
+	builder.SetFeeAmount(w.Client.GetFees(200_000))
+
+	gas, err := w.Client.SimulateTx(builder.GetTx())
+	if err != nil {
+		if unreachable(err) {
+			return 0, fmt.Errorf("cannot simulate | %w", err)
+		}
+		return 0, fmt.Errorf("%w: %s", ErrSimulation, status.Convert(err).Message())
+	}
+	return gas, nil
+}
+
+// unreachable reports whether a gRPC error is about the connection instead of the request
+func unreachable(err error) bool {
+	s, ok := status.FromError(err)
+	if !ok {
+		return true
+	}
+	switch s.Code() {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+func (c walletClient) Broadcast(gas uint64, signed func(txHash string), msgs ...sdk.Msg) (*sdk.TxResponse, error) {
+	data := walletTypes.NewTransactionData(
+		msgs...,
+	).WithGasLimit(gas).WithFeeAuto()
+
+	builder, err := c.w.BuildTx(data)
+	if err != nil {
+		return nil, err
+	}
+	tx := builder.GetTx()
+
+	bz, err := c.w.TxConfig.TxEncoder()(tx)
+	if err != nil {
+		return nil, err
+	}
+	signed(fmt.Sprintf("%X", sha256.Sum256(bz)))
+
+	return c.w.Client.BroadcastTxCommit(tx)
+}
+
+func (c walletClient) Lookup(ctx context.Context, txHash string) (*sdk.TxResponse, error) {
+	hash, err := hex.DecodeString(txHash)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tx hash %s | %w", txHash, err)
+	}
+
+	res, err := c.w.Client.RPCClient.Tx(ctx, hash, false)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &sdk.TxResponse{
+		TxHash:    txHash,
+		Height:    res.Height,
+		Code:      res.TxResult.Code,
+		Codespace: res.TxResult.Codespace,
+		RawLog:    res.TxResult.Log,
+	}, nil
+}
+
+// mempoolLimit is the number of unconfirmed transactions read from the node, the most it returns at once
+const mempoolLimit = 100
+
+func (c walletClient) Pending(ctx context.Context, txHash string) (bool, error) {
+	limit := mempoolLimit
+	res, err := c.w.Client.RPCClient.UnconfirmedTxs(ctx, &limit)
+	if err != nil {
+		return false, err
+	}
+	for _, tx := range res.Txs {
+		if strings.EqualFold(fmt.Sprintf("%X", tx.Hash()), txHash) {
+			return true, nil
+		}
+	}
+	return res.Total > len(res.Txs), nil
+}
+
+// Lookup returns the result of a transaction the queue broadcast before, or nil if it never made it on chain.
+// A transaction that was included but failed returns a *TxError.
+func (q *Queue) Lookup(ctx context.Context, txHash string) (*sdk.TxResponse, error) {
+	res, err := q.client.Lookup(ctx, txHash)
+	if err != nil || res == nil {
+		return nil, err
+	}
+	if res.Code != 0 {
+		return res, newTxError(res)
+	}
+	return res, nil
+}
+
+// broadcast simulates the messages together and posts them in a single transaction.
+// It also returns the hash of the transaction once it was signed, empty if it never got that far.
+func (q *Queue) broadcast(messages []*MsgHolder) (string, *sdk.TxResponse, error) {
+	var msgs []sdk.Msg
+	for _, message := range messages {
+		msgs = append(msgs, message.m)
+	}
+
+	gas, err := q.client.Simulate(msgs...)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var signedHash string
+	res, err := q.client.Broadcast(gas, func(txHash string) {
+		signedHash = txHash
+		for _, message := range messages {
+			if message.broadcast != nil {
+				message.broadcast(txHash)
+			}
+		}
+	}, msgs...)
+	if err != nil {
+		return signedHash, nil, err
+	}
+	if res == nil {
+		return signedHash, nil, errors.New("response is for sure empty")
+	}
+	if res.Code != 0 {
+		return signedHash, res, newTxError(res)
+	}
+	return signedHash, res, nil
+}
+
+// settle finds out what happened to a signed transaction whose broadcast failed, like on a commit timeout.
+// It returns the result of the transaction once it is included, or the broadcast error once the transaction
+// is neither in a block nor in the mempool of the node, twice in a row so one caught between the two is not missed.
+// If that can't be told before the settle timeout, the outcome is unknown and ErrInFlight is returned.
+func (q *Queue) settle(txHash string, broadcastErr error) (*sdk.TxResponse, error) {
+	deadline := time.Now().Add(settleTimeout)
+	absent := 0
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+		// the mempool is read first, a transaction leaving it for a block is then found by the lookup
+		pending, err := q.client.Pending(ctx, txHash)
+		var res *sdk.TxResponse
+		if err == nil {
+			res, err = q.Lookup(ctx, txHash)
+		}
+		cancel()
+
+		switch {
+		case res != nil:
+			return res, err
+		case err != nil:
+			log.Printf("cannot look up tx %s | %s", txHash, err.Error())
+			absent = 0
+		case pending:
+			absent = 0
+		default:
+			absent++
+			if absent == 2 {
+				return nil, broadcastErr
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w | tx %s was sent but its outcome is unknown | %w", ErrInFlight, txHash, broadcastErr)
+		}
+		time.Sleep(q.opts.FlushInterval)
+	}
+}
+
+// postBatch posts the messages in one transaction. If the chain rejects it, the batch is split in half
+// until the failing message is isolated and gets the error, the others are posted normally.
+// Batches that fail because the node can't be reached are requeued as they are, once their transaction,
+// if it was signed, is known not to be on chain. Otherwise their messages get ErrInFlight.
+func (q *Queue) postBatch(messages []*MsgHolder) {
+	txHash, res, err := q.broadcast(messages)
+	if err != nil && len(txHash) > 0 && !errors.Is(err, ErrSimulation) && !errors.Is(err, ErrTxFailed) {
+		res, err = q.settle(txHash, err)
+		if errors.Is(err, ErrInFlight) {
+			log.Printf("cannot tell if %d messages were posted | %s", len(messages), err.Error())
+			for _, msg := range messages {
+				msg.finish(nil, err)
+			}
+			return
+		}
+	}
+	if err == nil {
+		for _, msg := range messages {
+			msg.finish(res, nil)
+		}
+		return
+	}
+
+	if !errors.Is(err, ErrSimulation) && !errors.Is(err, ErrTxFailed) {
+		log.Printf("cannot post %d messages, requeueing | %s", len(messages), err.Error())
+		q.requeue(messages)
+		return
+	}
+
+	if len(messages) == 1 {
+		log.Printf("message failed | %s", err.Error())
+		messages[0].finish(res, err)
+		return
+	}
+
+	half := len(messages) / 2
+	log.Printf("batch of %d messages failed, splitting it | %s", len(messages), err.Error())
+	q.postBatch(messages[:half])
+	q.postBatch(messages[half:])
+}
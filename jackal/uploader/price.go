@@ -0,0 +1,203 @@
+package uploader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrStalePrice is returned when there is no JKL price recent enough to charge for a message
+var ErrStalePrice = errors.New("jkl price is stale")
+
+// DefaultGeckoURL is the CoinGecko endpoint used when no other is configured
+const DefaultGeckoURL = "https://api.coingecko.com/api/v3/simple/price?ids=jackal-protocol&vs_currencies=usd"
+
+// Quote is a JKL price in USD and when it was observed
+type Quote struct {
+	Price float64
+	Time  time.Time
+}
+
+// PriceOracle is a source of the JKL price
+type PriceOracle interface {
+	Name() string
+	Quote(ctx context.Context) (Quote, error)
+}
+
+type GeckoRes struct {
+	JackalPrice Price `json:"jackal-protocol"`
+}
+
+type Price struct {
+	USDPrice float64 `json:"usd"`
+}
+
+// GeckoOracle reads the JKL price from the CoinGecko simple price API
+type GeckoOracle struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewGeckoOracle(url string) *GeckoOracle {
+	if len(url) == 0 {
+		url = DefaultGeckoURL
+	}
+	return &GeckoOracle{URL: url, Client: http.DefaultClient}
+}
+
+func (g *GeckoOracle) Name() string {
+	return "coingecko"
+}
+
+func (g *GeckoOracle) Quote(ctx context.Context) (Quote, error) {
+	var priceResp GeckoRes
+	err := getJSON(ctx, g.Client, g.URL, &priceResp)
+	if err != nil {
+		return Quote{}, err
+	}
+	return Quote{Price: priceResp.JackalPrice.USDPrice, Time: time.Now()}, nil
+}
+
+// StaticOracle always returns the configured price, it never goes stale
+type StaticOracle struct {
+	Price float64
+}
+
+func (s StaticOracle) Name() string {
+	return "static"
+}
+
+func (s StaticOracle) Quote(_ context.Context) (Quote, error) {
+	return Quote{Price: s.Price, Time: time.Now()}, nil
+}
+
+// FeedRes is the document served by a price feed, Time is optional
+type FeedRes struct {
+	Price float64   `json:"price"`
+	Time  time.Time `json:"time,omitempty"`
+}
+
+// FeedOracle reads the JKL price from a json document at an http(s) URL or a local file.
+// Without a time in the document, the price is as old as the file, or fresh for an URL.
+type FeedOracle struct {
+	Source string
+	Client *http.Client
+}
+
+func NewFeedOracle(source string) *FeedOracle {
+	return &FeedOracle{Source: source, Client: http.DefaultClient}
+}
+
+func (f *FeedOracle) Name() string {
+	return f.Source
+}
+
+func (f *FeedOracle) Quote(ctx context.Context) (Quote, error) {
+	var feed FeedRes
+	observed := time.Now()
+
+	if strings.HasPrefix(f.Source, "http://") || strings.HasPrefix(f.Source, "https://") {
+		err := getJSON(ctx, f.Client, f.Source, &feed)
+		if err != nil {
+			return Quote{}, err
+		}
+	} else {
+		info, err := os.Stat(f.Source)
+		if err != nil {
+			return Quote{}, fmt.Errorf("cannot read price feed %s | %w", f.Source, err)
+		}
+		observed = info.ModTime()
+
+		data, err := os.ReadFile(f.Source)
+		if err != nil {
+			return Quote{}, fmt.Errorf("cannot read price feed %s | %w", f.Source, err)
+		}
+		err = json.Unmarshal(data, &feed)
+		if err != nil {
+			return Quote{}, fmt.Errorf("cannot parse price feed %s | %w", f.Source, err)
+		}
+	}
+
+	if !feed.Time.IsZero() {
+		observed = feed.Time
+	}
+	return Quote{Price: feed.Price, Time: observed}, nil
+}
+
+// MedianOracle combines several sources into the median of their prices, sources that fail or are older than MaxAge are left out.
+// The quote is as old as the oldest price it was made from.
+type MedianOracle struct {
+	Sources []PriceOracle
+	MaxAge  time.Duration
+}
+
+func (m MedianOracle) Name() string {
+	names := make([]string, len(m.Sources))
+	for i, s := range m.Sources {
+		names[i] = s.Name()
+	}
+	return fmt.Sprintf("median(%s)", strings.Join(names, ", "))
+}
+
+func (m MedianOracle) Quote(ctx context.Context) (Quote, error) {
+	var quotes []Quote
+	var errs []error
+	for _, s := range m.Sources {
+		q, err := s.Quote(ctx)
+		if err == nil && q.Price <= 0 {
+			err = fmt.Errorf("price %f is not positive", q.Price)
+		}
+		if err == nil && m.MaxAge > 0 && time.Since(q.Time) > m.MaxAge {
+			err = fmt.Errorf("price from %s | %w", q.Time.Format(time.RFC3339), ErrStalePrice)
+		}
+		if err != nil {
+			log.Printf("price source %s failed: %v", s.Name(), err)
+			errs = append(errs, fmt.Errorf("%s | %w", s.Name(), err))
+			continue
+		}
+		quotes = append(quotes, q)
+	}
+	if len(quotes) == 0 {
+		return Quote{}, fmt.Errorf("no price source answered | %w", errors.Join(errs...))
+	}
+
+	sort.Slice(quotes, func(i, j int) bool { return quotes[i].Price < quotes[j].Price })
+	median := quotes[len(quotes)/2].Price
+	if len(quotes)%2 == 0 {
+		median = (quotes[len(quotes)/2-1].Price + quotes[len(quotes)/2].Price) / 2
+	}
+
+	oldest := quotes[0].Time
+	for _, q := range quotes {
+		if q.Time.Before(oldest) {
+			oldest = q.Time
+		}
+	}
+	return Quote{Price: median, Time: oldest}, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	//nolint:errcheck
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,145 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubServer serves body with the given status on every request
+func stubServer(t *testing.T, status int, body string) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestGeckoOracle(t *testing.T) {
+	s := stubServer(t, http.StatusOK, `{"jackal-protocol":{"usd":0.42}}`)
+
+	q, err := NewGeckoOracle(s.URL).Quote(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Price != 0.42 {
+		t.Errorf("price is %f, want 0.42", q.Price)
+	}
+
+	s = stubServer(t, http.StatusTooManyRequests, `{"status":{"error_code":429}}`)
+	_, err = NewGeckoOracle(s.URL).Quote(context.Background())
+	if err == nil {
+		t.Errorf("want an error on a rate limited response")
+	}
+}
+
+func TestFeedOracleHTTP(t *testing.T) {
+	observed := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	s := stubServer(t, http.StatusOK, fmt.Sprintf(`{"price":0.3,"time":%q}`, observed.Format(time.RFC3339)))
+
+	q, err := NewFeedOracle(s.URL).Quote(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Price != 0.3 || !q.Time.Equal(observed) {
+		t.Errorf("got %f at %s", q.Price, q.Time)
+	}
+
+	s = stubServer(t, http.StatusOK, `not json`)
+	_, err = NewFeedOracle(s.URL).Quote(context.Background())
+	if err == nil {
+		t.Errorf("want an error on a broken feed")
+	}
+}
+
+func TestFeedOracleFile(t *testing.T) {
+	feed := filepath.Join(t.TempDir(), "price.json")
+	err := os.WriteFile(feed, []byte(`{"price":0.25}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Now().Add(-time.Hour)
+	err = os.Chtimes(feed, modified, modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := NewFeedOracle(feed).Quote(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Price != 0.25 {
+		t.Errorf("price is %f, want 0.25", q.Price)
+	}
+	if !q.Time.Equal(modified) {
+		t.Errorf("a feed without a time should be as old as the file, got %s", q.Time)
+	}
+}
+
+func TestMedianOracle(t *testing.T) {
+	down := stubServer(t, http.StatusInternalServerError, ``)
+	stale := stubServer(t, http.StatusOK, fmt.Sprintf(`{"price":9,"time":%q}`, time.Now().Add(-time.Hour).Format(time.RFC3339)))
+
+	m := MedianOracle{
+		Sources: []PriceOracle{
+			NewGeckoOracle(stubServer(t, http.StatusOK, `{"jackal-protocol":{"usd":0.4}}`).URL),
+			NewFeedOracle(stubServer(t, http.StatusOK, `{"price":0.2}`).URL),
+			StaticOracle{Price: 0.3},
+			StaticOracle{Price: 5},
+			NewFeedOracle(down.URL),
+			NewFeedOracle(stale.URL),
+		},
+		MaxAge: time.Minute,
+	}
+
+	q, err := m.Quote(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Price != 0.35 {
+		t.Errorf("median is %f, want 0.35", q.Price)
+	}
+
+	m = MedianOracle{Sources: []PriceOracle{NewFeedOracle(down.URL), NewFeedOracle(stale.URL)}, MaxAge: time.Minute}
+	_, err = m.Quote(context.Background())
+	if !errors.Is(err, ErrStalePrice) {
+		t.Errorf("want ErrStalePrice when every source failed, got %v", err)
+	}
+}
+
+func TestQueueUpdatePriceKeepsLastPrice(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte(`{"jackal-protocol":{"usd":0.5}}`))
+	}))
+	defer s.Close()
+
+	q := newTestQueue(&fakeClient{}, Options{Oracle: NewGeckoOracle(s.URL)})
+	err := q.UpdatePrice(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	healthy.Store(false)
+	err = q.UpdatePrice(context.Background())
+	if err == nil {
+		t.Fatalf("want an error from a failing oracle")
+	}
+	price, err := q.price()
+	if err != nil || price != 0.5 {
+		t.Errorf("the last price should be kept, got %f (%v)", price, err)
+	}
+}
@@ -1,14 +1,12 @@
 package uploader
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"net/http"
 	"sync"
 	"time"
 
-	walletTypes "github.com/desmos-labs/cosmos-go-wallet/types"
-
 	"github.com/rs/zerolog/log"
 
 	sdk "github.com/cosmos/cosmos-sdk/types"
@@ -16,50 +14,226 @@ import (
 )
 
 type MsgHolder struct {
-	m   sdk.Msg
-	r   *sdk.TxResponse
-	wg  *sync.WaitGroup
-	err error
+	m         sdk.Msg
+	r         *sdk.TxResponse
+	done      chan struct{}
+	err       error
+	broadcast func(txHash string)
+}
+
+// finish hands the result back to the caller waiting in Post
+func (m *MsgHolder) finish(r *sdk.TxResponse, err error) {
+	m.r = r
+	m.err = err
+	close(m.done)
+}
+
+var (
+	// ErrStopped is returned for messages that are posted after Stop or could not be posted before the Stop deadline
+	ErrStopped = errors.New("queue stopped")
+	// ErrInFlight is returned for messages sent in a transaction whose outcome could not be found out, they may still be executed
+	ErrInFlight = errors.New("message is in flight")
+	// ErrNotPosted is returned when Post gives up on a message before it was sent, it is not executed
+	ErrNotPosted = errors.New("message was not posted")
+)
+
+const (
+	defaultBatchSize      = 10
+	defaultFlushInterval  = time.Second
+	defaultMaxDepth       = 1000
+	defaultPriceInterval  = 10 * time.Minute
+	defaultParamsInterval = time.Hour
+)
+
+// DefaultMaxPriceAge is how old the JKL price can get when no max age is set
+const DefaultMaxPriceAge = 30 * time.Minute
+
+// Options tunes how the queue batches messages, zero values use the defaults
+type Options struct {
+	// BatchSize is the max number of messages per transaction, defaults to 10
+	BatchSize int
+	// FlushInterval is how often queued messages are posted, defaults to 1s
+	FlushInterval time.Duration
+	// MaxDepth is the max number of messages queued or in flight, Post waits for room past it. Defaults to 1000
+	MaxDepth int
+	// Oracle is where the JKL price comes from, defaults to CoinGecko
+	Oracle PriceOracle
+	// PriceInterval is how often the JKL price is updated, defaults to 10m
+	PriceInterval time.Duration
+	// MaxPriceAge is how old the JKL price can get before GetCost refuses to price messages, defaults to 30m
+	MaxPriceAge time.Duration
+	// Params is where the storage pricing comes from, defaults to the Jackal storage and bank modules
+	Params ParamsSource
+	// ParamsInterval is how often the storage pricing is read again, defaults to 1h
+	ParamsInterval time.Duration
+	// Fees is what is charged on top of the storage cost
+	Fees FeePolicy
 }
 
 type Queue struct {
-	messages []*MsgHolder
-	w        *wallet.Wallet
-	stopped  bool
-	jklPrice float64
+	mu        sync.Mutex
+	messages  []*MsgHolder
+	client    txClient
+	stopped   bool
+	listening bool
+	stop      chan struct{}
+	done      chan struct{}
+	slots     chan struct{}
+	opts      Options
+
+	priceMu sync.RWMutex
+	quote   Quote
+	params  StorageParams
 }
 
-func NewQueue(w *wallet.Wallet) *Queue {
+func NewQueue(w *wallet.Wallet, opts Options) *Queue {
+	if opts.Params == nil {
+		opts.Params = chainParams{conn: w.Client.GRPCConn}
+	}
+	return newQueue(walletClient{w: w}, opts)
+}
+
+func newQueue(client txClient, opts Options) *Queue {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultFlushInterval
+	}
+	if opts.MaxDepth <= 0 {
+		opts.MaxDepth = defaultMaxDepth
+	}
+	if opts.Oracle == nil {
+		opts.Oracle = NewGeckoOracle(DefaultGeckoURL)
+	}
+	if opts.PriceInterval <= 0 {
+		opts.PriceInterval = defaultPriceInterval
+	}
+	if opts.MaxPriceAge <= 0 {
+		opts.MaxPriceAge = DefaultMaxPriceAge
+	}
+	if opts.ParamsInterval <= 0 {
+		opts.ParamsInterval = defaultParamsInterval
+	}
+	if opts.Fees.Markup <= 0 {
+		opts.Fees.Markup = defaultMarkup
+	}
+
 	q := Queue{
 		messages: make([]*MsgHolder, 0),
-		w:        w,
+		client:   client,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		slots:    make(chan struct{}, opts.MaxDepth),
+		opts:     opts,
 	}
 	return &q
 }
 
-func (q *Queue) Stop() {
+// Stop stops accepting messages and keeps posting the queued ones until the queue is empty or ctx is done.
+// Messages that are still queued after that are failed with ErrStopped.
+func (q *Queue) Stop(ctx context.Context) error {
+	q.mu.Lock()
+	if q.stopped {
+		q.mu.Unlock()
+		return nil
+	}
 	q.stopped = true
+	listening := q.listening
+	q.mu.Unlock()
+
+	close(q.stop)
+	if listening {
+		<-q.done // let the batch in flight finish
+	}
+
+	for q.Len() > 0 {
+		q.popAndPost(q.opts.BatchSize)
+		if q.Len() == 0 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			left := q.failAll(ErrStopped)
+			return fmt.Errorf("%d messages were not posted | %w", left, ctx.Err())
+		case <-time.After(q.opts.FlushInterval):
+		}
+	}
+
+	return nil
 }
 
+// Len returns the number of queued messages
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.messages)
+}
+
+// failAll empties the queue, releasing every waiting message with the given error
+func (q *Queue) failAll(err error) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, m := range q.messages {
+		m.finish(nil, err)
+	}
+	left := len(q.messages)
+	q.messages = nil
+	return left
+}
+
+// Listen posts the queued messages every flush interval and keeps the JKL price and storage params up to date until Stop
 func (q *Queue) Listen() {
+	q.mu.Lock()
+	if q.listening || q.stopped {
+		q.mu.Unlock()
+		return
+	}
+	q.listening = true
+	q.mu.Unlock()
+
 	go func() {
-		for !q.stopped {
-			time.Sleep(time.Millisecond * 1000)
-			q.popAndPost(10)
+		defer close(q.done)
+		ticker := time.NewTicker(q.opts.FlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-q.stop:
+				return
+			case <-ticker.C:
+				q.popAndPost(q.opts.BatchSize)
+			}
 		}
 	}()
 
-	go func() {
-		for !q.stopped {
-			_ = q.UpdateGecko() // updating price oracle every 5 minutes, we don't care about errors tbh
-			time.Sleep(time.Minute * 10)
+	go q.refresh("jkl price", q.opts.PriceInterval, q.UpdatePrice)
+	go q.refresh("storage params", q.opts.ParamsInterval, q.UpdateStorageParams)
+}
 
+// refresh calls update every interval until Stop, keeping the last value when it fails
+func (q *Queue) refresh(name string, interval time.Duration, update func(ctx context.Context) error) {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := update(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("cannot update %s, keeping the last one: %v", name, err)
 		}
-	}()
+
+		select {
+		case <-q.stop:
+			return
+		case <-time.After(interval):
+		}
+	}
 }
 
 func (q *Queue) popAndPost(count int) {
+	q.mu.Lock()
 	if len(q.messages) == 0 {
+		q.mu.Unlock()
 		return
 	}
 
@@ -69,112 +243,125 @@ func (q *Queue) popAndPost(count int) {
 
 	newMessages := q.messages[0:count]
 	q.messages = q.messages[count:]
+	q.mu.Unlock()
 
-	var msgs []sdk.Msg
+	q.postBatch(newMessages)
+}
 
-	for _, message := range newMessages {
-		msgs = append(msgs, message.m)
-	}
+func (q *Queue) requeue(messages []*MsgHolder) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.messages = append(q.messages, messages...)
+}
 
-	data := walletTypes.NewTransactionData(
-		msgs...,
-	).WithGasAuto().WithFeeAuto()
+// Post waits until the message is executed on chain or ctx is done. The message is simulated first,
+// so a message the chain rejects fails right away instead of joining a batch.
+// A transaction that is included but fails returns a *TxError. Once ctx is done, a message that is still queued
+// is taken out and gets ErrNotPosted, one that is already being broadcast is waited for.
+func (q *Queue) Post(ctx context.Context, msg sdk.Msg) (*sdk.TxResponse, error) {
+	return q.PostTracked(ctx, msg, nil)
+}
 
-	res, err := q.w.BroadcastTxCommit(data)
-	if err != nil {
-		fmt.Println(err)
-		q.messages = append(q.messages, newMessages...)
-		return
+// PostTracked is Post, calling broadcast with the hash of every transaction the message is sent in before it is sent
+func (q *Queue) PostTracked(ctx context.Context, msg sdk.Msg, broadcast func(txHash string)) (*sdk.TxResponse, error) {
+	fmt.Println("posting message...")
+
+	select {
+	case q.slots <- struct{}{}:
+		defer func() { <-q.slots }()
+	case <-q.stop:
+		return nil, ErrStopped
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%w, queue is full | %w", ErrNotPosted, ctx.Err())
 	}
-	if res == nil {
-		fmt.Println("response is for sure empty")
-		q.messages = append(q.messages, newMessages...)
-		return
+
+	_, err := q.client.Simulate(msg)
+	if errors.Is(err, ErrSimulation) {
+		return nil, err
 	}
-	for _, msg := range newMessages {
-		msg.r = res
-		msg.err = err
-		msg.wg.Done()
+	if err != nil { // the batch is simulated again before it is posted
+		log.Printf("cannot simulate message, queueing it anyway | %s", err.Error())
 	}
-}
-
-func (q *Queue) Post(msg sdk.Msg) (*sdk.TxResponse, error) {
-	fmt.Println("posting message...")
 
-	var wg sync.WaitGroup
 	m := MsgHolder{
-		m:  msg,
-		wg: &wg,
+		m:         msg,
+		done:      make(chan struct{}),
+		broadcast: broadcast,
 	}
-	wg.Add(1)
 
+	q.mu.Lock()
+	if q.stopped {
+		q.mu.Unlock()
+		return nil, ErrStopped
+	}
 	q.messages = append(q.messages, &m)
+	q.mu.Unlock()
 
 	fmt.Println("waiting...")
 
-	wg.Wait()
-
-	return m.r, nil
-}
+	select {
+	case <-m.done:
+		return m.r, m.err
+	case <-ctx.Done():
+	}
 
-type GeckoRes struct {
-	JackalPrice Price `json:"jackal-protocol"`
+	// a message taken into a batch can't be called back, the batch is waited for so the caller knows if it was executed
+	for {
+		if q.remove(&m) {
+			return nil, fmt.Errorf("%w | %w", ErrNotPosted, ctx.Err())
+		}
+		select {
+		case <-m.done:
+			return m.r, m.err
+		case <-time.After(q.opts.FlushInterval):
+		}
+	}
 }
 
-type Price struct {
-	USDPrice float64 `json:"usd"`
+// remove takes a message out of the queue, returning false if it was already taken to be posted
+func (q *Queue) remove(m *MsgHolder) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, other := range q.messages {
+		if other == m {
+			q.messages = append(q.messages[:i:i], q.messages[i+1:]...)
+			return true
+		}
+	}
+	return false
 }
 
-func (q *Queue) UpdateGecko() error {
-	log.Print("updating gecko...")
-	const u = "https://api.coingecko.com/api/v3/simple/price?ids=jackal-protocol&vs_currencies=usd"
-	resp, err := http.Get(u)
+// UpdatePrice gets a new JKL price from the oracle
+func (q *Queue) UpdatePrice(ctx context.Context) error {
+	quote, err := q.opts.Oracle.Quote(ctx)
 	if err != nil {
-		return err
+		return fmt.Errorf("cannot get price from %s | %w", q.opts.Oracle.Name(), err)
 	}
-	//nolint:errcheck
-	defer resp.Body.Close()
-
-	var priceResp GeckoRes
-	if err := json.NewDecoder(resp.Body).Decode(&priceResp); err != nil {
-		return err
+	if quote.Price <= 0 {
+		return fmt.Errorf("price %f from %s is not positive", quote.Price, q.opts.Oracle.Name())
 	}
 
-	q.jklPrice = priceResp.JackalPrice.USDPrice
-	log.Printf("updated gecko with %f", q.jklPrice)
-
+	q.setQuote(quote)
+	log.Printf("updated jkl price from %s with %f", q.opts.Oracle.Name(), quote.Price)
 	return nil
 }
 
-func (q *Queue) GetCost(totalSize int64, hours int64) int64 {
-	kbs := totalSize / 1000
-	var kbMin int64 = 1024
-	if kbs < kbMin { // minimum amount of kbs to post
-		kbs = kbMin
-	}
-
-	pricePerTBPerMonth := sdk.NewDec(15)
-	quantifiedPricePerTBPerMonth := pricePerTBPerMonth.QuoInt64(3)
-	pricePerGbPerMonth := quantifiedPricePerTBPerMonth.QuoInt64(1000)
-	pricePerMbPerMonth := pricePerGbPerMonth.QuoInt64(1000)
-	pricePerKbPerMonth := pricePerMbPerMonth.QuoInt64(1000)
-	pricePerKbPerHour := pricePerKbPerMonth.QuoInt64(720)
-
-	pricePerHour := pricePerKbPerHour.MulInt64(kbs)
-
-	totalCost := pricePerHour.MulInt64(hours)
-
-	log.Printf("JKL Price := %f", q.jklPrice)
-
-	jklPrice, _ := sdk.NewDecFromStr(fmt.Sprintf("%f", q.jklPrice))
-
-	// TODO: fetch denom unit from bank module
-	var ujklUnit int64 = 1000000
-	jklCost := totalCost.Quo(jklPrice)
-
-	ujklCost := jklCost.MulInt64(ujklUnit)
+func (q *Queue) setQuote(quote Quote) {
+	q.priceMu.Lock()
+	defer q.priceMu.Unlock()
+	q.quote = quote
+}
 
-	log.Printf("uJKL Price := %d", ujklCost.TruncateInt64())
+// price returns the JKL price, or ErrStalePrice if there is none or it is older than the max price age
+func (q *Queue) price() (float64, error) {
+	q.priceMu.RLock()
+	defer q.priceMu.RUnlock()
 
-	return ujklCost.TruncateInt64()
+	if q.quote.Price <= 0 {
+		return 0, fmt.Errorf("no price yet | %w", ErrStalePrice)
+	}
+	if age := time.Since(q.quote.Time); age > q.opts.MaxPriceAge {
+		return 0, fmt.Errorf("last price is %s old | %w", age.Round(time.Second), ErrStalePrice)
+	}
+	return q.quote.Price, nil
 }
@@ -0,0 +1,414 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	banktypes "github.com/cosmos/cosmos-sdk/x/bank/types"
+)
+
+// fakeClient records the batches it is asked to post.
+// Messages to an address in reject fail simulation, batches with a message to an address in fail fail on chain.
+// The first timeouts broadcasts fail after they were signed, their transaction is included anyway if land is set.
+type fakeClient struct {
+	mu       sync.Mutex
+	batches  [][]sdk.Msg
+	reject   map[string]bool
+	fail     map[string]bool
+	hold     chan struct{}
+	timeouts int
+	land     bool
+	included map[string]*sdk.TxResponse
+}
+
+func (c *fakeClient) Simulate(msgs ...sdk.Msg) (uint64, error) {
+	for _, m := range msgs {
+		if c.reject[to(m)] {
+			return 0, fmt.Errorf("%w: rejected %s", ErrSimulation, to(m))
+		}
+	}
+	return 100_000, nil
+}
+
+func (c *fakeClient) Broadcast(_ uint64, signed func(txHash string), msgs ...sdk.Msg) (*sdk.TxResponse, error) {
+	if c.hold != nil {
+		<-c.hold
+	}
+
+	c.mu.Lock()
+	c.batches = append(c.batches, msgs)
+	n := len(c.batches)
+	c.mu.Unlock()
+
+	res := sdk.TxResponse{TxHash: fmt.Sprintf("TX%d", n)}
+	signed(res.TxHash)
+	for i, m := range msgs {
+		if c.fail[to(m)] {
+			res.Code = 5
+			res.Codespace = "wasm"
+			res.RawLog = fmt.Sprintf("failed to execute message; message index: %d: Generic error: bad %s: execute wasm contract failed", i, to(m))
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timeouts > 0 {
+		c.timeouts--
+		if c.land {
+			if c.included == nil {
+				c.included = make(map[string]*sdk.TxResponse)
+			}
+			c.included[res.TxHash] = &res
+		}
+		return nil, errors.New("timed out waiting for tx to be included in a block")
+	}
+	return &res, nil
+}
+
+func (c *fakeClient) Lookup(_ context.Context, txHash string) (*sdk.TxResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.included[txHash], nil
+}
+
+func (c *fakeClient) Pending(_ context.Context, _ string) (bool, error) {
+	return false, nil
+}
+
+// fakeParams always returns the same storage pricing
+type fakeParams StorageParams
+
+func (p fakeParams) StorageParams(_ context.Context) (StorageParams, error) {
+	params := StorageParams(p)
+	params.Time = time.Now()
+	return params, nil
+}
+
+func (c *fakeClient) Batches() [][]sdk.Msg {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.batches
+}
+
+func msgTo(address string) sdk.Msg {
+	return &banktypes.MsgSend{FromAddress: "relay", ToAddress: address}
+}
+
+func to(m sdk.Msg) string {
+	return m.(*banktypes.MsgSend).ToAddress
+}
+
+func newTestQueue(client txClient, opts Options) *Queue {
+	if opts.Oracle == nil {
+		opts.Oracle = StaticOracle{Price: 0.5}
+	}
+	if opts.Params == nil {
+		opts.Params = fakeParams{PricePerTBPerMonth: 15, DenomUnit: 1_000_000}
+	}
+	return newQueue(client, opts)
+}
+
+func stopQueue(t *testing.T, q *Queue) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := q.Stop(ctx)
+	if err != nil {
+		t.Fatalf("cannot stop queue: %v", err)
+	}
+}
+
+func TestQueueConcurrentPost(t *testing.T) {
+	client := &fakeClient{}
+	q := newTestQueue(client, Options{BatchSize: 7, FlushInterval: 5 * time.Millisecond})
+	q.Listen()
+	defer stopQueue(t, q)
+
+	const count = 100
+	var wg sync.WaitGroup
+	errs := make([]error, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = q.Post(context.Background(), msgTo(fmt.Sprintf("user%d", i)))
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("message %d: %v", i, err)
+		}
+	}
+
+	posted := 0
+	for _, b := range client.Batches() {
+		if len(b) > 7 {
+			t.Errorf("batch of %d messages is over the batch size", len(b))
+		}
+		posted += len(b)
+	}
+	if posted != count {
+		t.Errorf("posted %d messages, want %d", posted, count)
+	}
+}
+
+func TestQueueIsolatesFailingMessage(t *testing.T) {
+	client := &fakeClient{fail: map[string]bool{"bad": true}}
+	q := newTestQueue(client, Options{BatchSize: 10, FlushInterval: time.Hour})
+
+	addresses := []string{"a", "b", "c", "d", "bad", "e", "f", "g", "h", "i"}
+	var wg sync.WaitGroup
+	errs := make(map[string]error)
+	var mu sync.Mutex
+	for _, address := range addresses {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			_, err := q.Post(context.Background(), msgTo(address))
+			mu.Lock()
+			errs[address] = err
+			mu.Unlock()
+		}(address)
+	}
+	waitForLen(t, q, len(addresses))
+
+	q.popAndPost(10)
+	wg.Wait()
+
+	for _, address := range addresses {
+		err := errs[address]
+		if address != "bad" {
+			if err != nil {
+				t.Errorf("%s: %v", address, err)
+			}
+			continue
+		}
+
+		var txErr *TxError
+		if !errors.As(err, &txErr) || !errors.Is(err, ErrTxFailed) {
+			t.Fatalf("bad: want a TxError, got %v", err)
+		}
+		if txErr.WasmError != "Generic error: bad bad" {
+			t.Errorf("wasm error is %q", txErr.WasmError)
+		}
+	}
+
+	stopQueue(t, q)
+}
+
+func TestQueueSettlesFailedBroadcast(t *testing.T) {
+	tests := []struct {
+		name    string
+		land    bool
+		batches int
+	}{
+		{name: "lost tx is posted again", land: false, batches: 2},
+		{name: "included tx is not posted again", land: true, batches: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeClient{timeouts: 1, land: tt.land}
+			q := newTestQueue(client, Options{FlushInterval: time.Millisecond})
+			q.Listen()
+			defer stopQueue(t, q)
+
+			var hashes []string
+			var mu sync.Mutex
+			res, err := q.PostTracked(context.Background(), msgTo("user"), func(txHash string) {
+				mu.Lock()
+				hashes = append(hashes, txHash)
+				mu.Unlock()
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(client.Batches()) != tt.batches {
+				t.Errorf("message was broadcast %d times, want %d", len(client.Batches()), tt.batches)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if res.TxHash != hashes[len(hashes)-1] {
+				t.Errorf("result is for %s, last signed tx is %s", res.TxHash, hashes[len(hashes)-1])
+			}
+		})
+	}
+}
+
+func TestQueueRejectsOnSimulation(t *testing.T) {
+	client := &fakeClient{reject: map[string]bool{"nope": true}}
+	q := newTestQueue(client, Options{FlushInterval: time.Hour})
+	defer stopQueue(t, q)
+
+	_, err := q.Post(context.Background(), msgTo("nope"))
+	if !errors.Is(err, ErrSimulation) {
+		t.Fatalf("want ErrSimulation, got %v", err)
+	}
+	if q.Len() != 0 {
+		t.Errorf("rejected message was queued")
+	}
+}
+
+func TestQueuePostDeadline(t *testing.T) {
+	q := newTestQueue(&fakeClient{}, Options{FlushInterval: time.Hour})
+	defer stopQueue(t, q)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err := q.Post(ctx, msgTo("slow"))
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, ErrNotPosted) {
+		t.Fatalf("want a deadline error for a message that was not posted, got %v", err)
+	}
+	if q.Len() != 0 {
+		t.Errorf("timed out message is still queued")
+	}
+}
+
+func TestQueuePostWaitsForBatchInFlight(t *testing.T) {
+	client := &fakeClient{hold: make(chan struct{})}
+	q := newTestQueue(client, Options{FlushInterval: time.Millisecond})
+	q.Listen()
+	defer stopQueue(t, q)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		time.Sleep(20 * time.Millisecond)
+		close(client.hold)
+	}()
+
+	res, err := q.Post(ctx, msgTo("user"))
+	if err != nil || res == nil {
+		t.Fatalf("want the result of the batch in flight, got %v", err)
+	}
+}
+
+func TestQueueMaxDepth(t *testing.T) {
+	client := &fakeClient{hold: make(chan struct{})}
+	q := newTestQueue(client, Options{BatchSize: 1, FlushInterval: 5 * time.Millisecond, MaxDepth: 2})
+	q.Listen()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := q.Post(context.Background(), msgTo(fmt.Sprintf("user%d", i)))
+			if err != nil {
+				t.Errorf("user%d: %v", i, err)
+			}
+		}(i)
+	}
+
+	// both slots are taken until the held broadcasts go through
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := q.Post(ctx, msgTo("late"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want a deadline error on a full queue, got %v", err)
+	}
+
+	close(client.hold)
+	wg.Wait()
+	stopQueue(t, q)
+}
+
+func TestQueueStopDrains(t *testing.T) {
+	client := &fakeClient{}
+	q := newTestQueue(client, Options{BatchSize: 3, FlushInterval: time.Millisecond})
+
+	const count = 8
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := q.Post(context.Background(), msgTo(fmt.Sprintf("user%d", i)))
+			if err != nil {
+				t.Errorf("user%d: %v", i, err)
+			}
+		}(i)
+	}
+	waitForLen(t, q, count)
+
+	stopQueue(t, q)
+	wg.Wait()
+
+	_, err := q.Post(context.Background(), msgTo("after"))
+	if !errors.Is(err, ErrStopped) {
+		t.Fatalf("want ErrStopped after Stop, got %v", err)
+	}
+}
+
+func TestQueuePrice(t *testing.T) {
+	q := newTestQueue(&fakeClient{}, Options{})
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			q.setQuote(Quote{Price: float64(i) / 10, Time: time.Now()})
+		}(i)
+		go func() {
+			defer wg.Done()
+			err := q.UpdatePrice(context.Background())
+			if err == nil {
+				err = q.UpdateStorageParams(context.Background())
+			}
+			if err != nil {
+				t.Errorf("cannot update pricing: %v", err)
+				return
+			}
+			cost, err := q.GetCost(1_000_000_000, 720)
+			if err != nil || cost <= 0 {
+				t.Errorf("cost should be positive, got %d (%v)", cost, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestQueueStalePrice(t *testing.T) {
+	q := newTestQueue(&fakeClient{}, Options{MaxPriceAge: time.Minute})
+	err := q.UpdateStorageParams(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = q.GetCost(1_000_000_000, 720)
+	if !errors.Is(err, ErrStalePrice) {
+		t.Fatalf("want ErrStalePrice without a price, got %v", err)
+	}
+
+	q.setQuote(Quote{Price: 0.5, Time: time.Now().Add(-time.Hour)})
+	_, err = q.GetCost(1_000_000_000, 720)
+	if !errors.Is(err, ErrStalePrice) {
+		t.Fatalf("want ErrStalePrice with an old price, got %v", err)
+	}
+
+	q.setQuote(Quote{Price: 0.5, Time: time.Now()})
+	_, err = q.GetCost(1_000_000_000, 720)
+	if err != nil {
+		t.Fatalf("fresh price: %v", err)
+	}
+}
+
+func waitForLen(t *testing.T, q *Queue, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for q.Len() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d of %d messages were queued", q.Len(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,196 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	banktypes "github.com/cosmos/cosmos-sdk/x/bank/types"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrNoStorageParams is returned when the storage pricing was never read from Jackal
+var ErrNoStorageParams = errors.New("storage params are not loaded")
+
+const (
+	// PaymentDenom is the denom storage is paid in
+	PaymentDenom = "ujkl"
+	// defaultDenomUnit is the number of ujkl per JKL when the chain has no denom metadata for it
+	defaultDenomUnit int64 = 1_000_000
+	// redundancy is the number of copies a file is stored with, the chain price covers all of them
+	redundancy = 3
+)
+
+// StorageParams are the Jackal values storage is priced from
+type StorageParams struct {
+	// PricePerTBPerMonth is the USD price of a TB stored for a month
+	PricePerTBPerMonth int64
+	// DenomUnit is the number of PaymentDenom per JKL
+	DenomUnit int64
+	Time      time.Time
+}
+
+// ParamsSource reads the storage pricing from Jackal
+type ParamsSource interface {
+	StorageParams(ctx context.Context) (StorageParams, error)
+}
+
+// chainParams reads the storage module params and the bank metadata of the payment denom over gRPC
+type chainParams struct {
+	conn *grpc.ClientConn
+}
+
+func (c chainParams) StorageParams(ctx context.Context) (StorageParams, error) {
+	price, err := c.pricePerTB(ctx)
+	if err != nil {
+		return StorageParams{}, fmt.Errorf("cannot query storage params | %w", err)
+	}
+
+	unit, err := c.denomUnit(ctx)
+	if err != nil {
+		return StorageParams{}, fmt.Errorf("cannot query %s metadata | %w", PaymentDenom, err)
+	}
+
+	return StorageParams{PricePerTBPerMonth: price, DenomUnit: unit, Time: time.Now()}, nil
+}
+
+// denomUnit returns the number of base units in the display unit of the payment denom
+func (c chainParams) denomUnit(ctx context.Context) (int64, error) {
+	res, err := banktypes.NewQueryClient(c.conn).DenomMetadata(ctx, &banktypes.QueryDenomMetadataRequest{Denom: PaymentDenom})
+	if status.Code(err) == codes.NotFound {
+		log.Printf("no denom metadata for %s, using %d per JKL", PaymentDenom, defaultDenomUnit)
+		return defaultDenomUnit, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return displayUnit(res.Metadata)
+}
+
+// displayUnit returns 10^exponent of the display unit of a denom
+func displayUnit(metadata banktypes.Metadata) (int64, error) {
+	for _, u := range metadata.DenomUnits {
+		if u.Denom != metadata.Display {
+			continue
+		}
+		if u.Exponent > 18 {
+			return 0, fmt.Errorf("exponent %d of %s is too large", u.Exponent, u.Denom)
+		}
+		unit := int64(1)
+		for i := uint32(0); i < u.Exponent; i++ {
+			unit *= 10
+		}
+		return unit, nil
+	}
+	return 0, fmt.Errorf("display unit %q of %s is not listed", metadata.Display, metadata.Base)
+}
+
+// FeePolicy is what the relay charges on top of the storage cost
+type FeePolicy struct {
+	// Markup multiplies the storage cost, defaults to 1.2
+	Markup float64
+	// FlatFee is added to every paid message, in PaymentDenom
+	FlatFee int64
+}
+
+const defaultMarkup = 1.2
+
+func (f FeePolicy) apply(cost int64) int64 {
+	return int64(float64(cost)*f.Markup) + f.FlatFee
+}
+
+// UpdateStorageParams reads the storage pricing from Jackal
+func (q *Queue) UpdateStorageParams(ctx context.Context) error {
+	params, err := q.opts.Params.StorageParams(ctx)
+	if err != nil {
+		return err
+	}
+	if params.PricePerTBPerMonth <= 0 || params.DenomUnit <= 0 {
+		return fmt.Errorf("storage params %+v are not usable", params)
+	}
+
+	q.priceMu.Lock()
+	changed := q.params.PricePerTBPerMonth != params.PricePerTBPerMonth || q.params.DenomUnit != params.DenomUnit
+	q.params = params
+	q.priceMu.Unlock()
+
+	if changed {
+		log.Printf("storage costs $%d/TB/month, %d %s per JKL", params.PricePerTBPerMonth, params.DenomUnit, PaymentDenom)
+	}
+	return nil
+}
+
+func (q *Queue) storageParams() (StorageParams, error) {
+	q.priceMu.RLock()
+	defer q.priceMu.RUnlock()
+
+	if q.params.PricePerTBPerMonth <= 0 {
+		return StorageParams{}, ErrNoStorageParams
+	}
+	return q.params, nil
+}
+
+// USDValue returns what an amount of ujkl is worth in USD at the current JKL price
+func (q *Queue) USDValue(ujkl int64) (float64, error) {
+	price, err := q.price()
+	if err != nil {
+		return 0, err
+	}
+	params, err := q.storageParams()
+	if err != nil {
+		return 0, err
+	}
+	return float64(ujkl) / float64(params.DenomUnit) * price, nil
+}
+
+// GetCost returns what is charged in ujkl for storing totalSize bytes for a number of hours, fee policy included.
+// It fails with ErrStalePrice if the JKL price is not current and ErrNoStorageParams before the pricing was read from Jackal.
+// Nothing is stored for zero hours, so that cost is the fees alone and needs neither.
+func (q *Queue) GetCost(totalSize int64, hours int64) (int64, error) {
+	if hours == 0 {
+		return q.opts.Fees.apply(0), nil
+	}
+
+	price, err := q.price()
+	if err != nil {
+		return 0, err
+	}
+	params, err := q.storageParams()
+	if err != nil {
+		return 0, err
+	}
+
+	kbs := totalSize / 1000
+	var kbMin int64 = 1024
+	if kbs < kbMin { // minimum amount of kbs to post
+		kbs = kbMin
+	}
+
+	pricePerTBPerMonth := sdk.NewDec(params.PricePerTBPerMonth)
+	quantifiedPricePerTBPerMonth := pricePerTBPerMonth.QuoInt64(redundancy)
+	pricePerGbPerMonth := quantifiedPricePerTBPerMonth.QuoInt64(1000)
+	pricePerMbPerMonth := pricePerGbPerMonth.QuoInt64(1000)
+	pricePerKbPerMonth := pricePerMbPerMonth.QuoInt64(1000)
+	pricePerKbPerHour := pricePerKbPerMonth.QuoInt64(720)
+
+	pricePerHour := pricePerKbPerHour.MulInt64(kbs)
+
+	totalCost := pricePerHour.MulInt64(hours)
+
+	log.Printf("JKL Price := %f", price)
+
+	jklPrice, _ := sdk.NewDecFromStr(fmt.Sprintf("%f", price))
+
+	jklCost := totalCost.Quo(jklPrice)
+
+	ujklCost := jklCost.MulInt64(params.DenomUnit)
+
+	log.Printf("uJKL Price := %d", ujklCost.TruncateInt64())
+
+	return q.opts.Fees.apply(ujklCost.TruncateInt64()), nil
+}
@@ -0,0 +1,16 @@
+package uploader
+
+import (
+	"context"
+
+	storagetypes "github.com/jackalLabs/canine-chain/v4/x/storage/types"
+)
+
+// pricePerTB returns the USD price of a TB per month from the storage module params
+func (c chainParams) pricePerTB(ctx context.Context) (int64, error) {
+	res, err := storagetypes.NewQueryClient(c.conn).Params(ctx, &storagetypes.QueryParams{})
+	if err != nil {
+		return 0, err
+	}
+	return res.Params.PricePerTbPerMonth, nil
+}
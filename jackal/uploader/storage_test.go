@@ -0,0 +1,123 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	banktypes "github.com/cosmos/cosmos-sdk/x/bank/types"
+)
+
+func TestGetCost(t *testing.T) {
+	q := newTestQueue(&fakeClient{}, Options{})
+
+	_, err := q.GetCost(1_000_000_000, 720)
+	if !errors.Is(err, ErrStalePrice) {
+		t.Fatalf("want ErrStalePrice before the price is read, got %v", err)
+	}
+	q.setQuote(Quote{Price: 0.5, Time: time.Now()})
+	_, err = q.GetCost(1_000_000_000, 720)
+	if !errors.Is(err, ErrNoStorageParams) {
+		t.Fatalf("want ErrNoStorageParams before the params are read, got %v", err)
+	}
+
+	err = q.UpdateStorageParams(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a GB for a month at $15/TB/month over 3 copies is $0.005, 0.01 JKL at $0.5, 10000 ujkl plus the 1.2 markup
+	cost, err := q.GetCost(1_000_000_000, 720)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !near(cost, 12_000) {
+		t.Errorf("cost is %d, want 12000", cost)
+	}
+
+	q = newTestQueue(&fakeClient{}, Options{
+		Params: fakeParams{PricePerTBPerMonth: 30, DenomUnit: 1_000_000},
+		Fees:   FeePolicy{Markup: 1, FlatFee: 500},
+	})
+	q.setQuote(Quote{Price: 0.5, Time: time.Now()})
+	err = q.UpdateStorageParams(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cost, err = q.GetCost(1_000_000_000, 720)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !near(cost, 20_500) {
+		t.Errorf("cost with a doubled price and a flat fee is %d, want 20500", cost)
+	}
+}
+
+func TestGetCostWithoutHours(t *testing.T) {
+	q := newTestQueue(&fakeClient{}, Options{Fees: FeePolicy{Markup: 1.2, FlatFee: 500}})
+
+	// no price or params were read, storing nothing only costs the flat fee
+	cost, err := q.GetCost(1_000_000_000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost != 500 {
+		t.Errorf("cost is %d, want the 500 flat fee", cost)
+	}
+}
+
+func TestUSDValue(t *testing.T) {
+	q := newTestQueue(&fakeClient{}, Options{})
+	q.setQuote(Quote{Price: 0.5, Time: time.Now()})
+	err := q.UpdateStorageParams(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := q.USDValue(3_000_000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 1.5 {
+		t.Errorf("3 JKL at $0.5 is worth $%f, want $1.5", value)
+	}
+}
+
+func TestUpdateStorageParamsRejectsZero(t *testing.T) {
+	q := newTestQueue(&fakeClient{}, Options{Params: fakeParams{DenomUnit: 1_000_000}})
+	err := q.UpdateStorageParams(context.Background())
+	if err == nil {
+		t.Fatalf("want an error on a zero storage price")
+	}
+}
+
+func TestDisplayUnit(t *testing.T) {
+	metadata := banktypes.Metadata{
+		Base:    "ujkl",
+		Display: "jkl",
+		DenomUnits: []*banktypes.DenomUnit{
+			{Denom: "ujkl", Exponent: 0},
+			{Denom: "mjkl", Exponent: 3},
+			{Denom: "jkl", Exponent: 6},
+		},
+	}
+	unit, err := displayUnit(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unit != 1_000_000 {
+		t.Errorf("unit is %d, want 1000000", unit)
+	}
+
+	metadata.Display = "kjkl"
+	_, err = displayUnit(metadata)
+	if err == nil {
+		t.Errorf("want an error when the display unit is missing")
+	}
+}
+
+// near allows for the precision lost dividing the price down to a kb per hour
+func near(cost int64, want int64) bool {
+	return cost >= want-5 && cost <= want
+}
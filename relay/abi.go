@@ -1,48 +1,48 @@
 package relay
 
 import (
-	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"os/exec"
 	"strconv"
 	"strings"
-	"time"
 
 	_ "embed"
 
 	"github.com/CosmWasm/wasmd/x/wasm"
+	"github.com/JackalLabs/mulberry/config"
 	"github.com/JackalLabs/mulberry/jackal/uploader"
 	evmTypes "github.com/JackalLabs/mulberry/types"
 	sdk "github.com/cosmos/cosmos-sdk/types"
 	"github.com/desmos-labs/cosmos-go-wallet/wallet"
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/crypto"
-	hdwallet "github.com/miguelmota/go-ethereum-hdwallet"
 )
 
 //go:embed abi.json
 var ABI string
 
-// from `forge inspect Jackal abi`
+// from `forge inspect Jackal abi`, plus finishMessage of JackalBridge
 
 var eventABI abi.ABI
 
+// abiVersions are the bridge contract ABIs shipped with the relay
+var abiVersions = map[string]abi.ABI{}
+
 func init() {
 	e, errABI := abi.JSON(strings.NewReader(ABI))
 	if errABI != nil {
 		log.Fatalf("Failed to parse ABI: %v", errABI)
 	}
 	eventABI = e
+	abiVersions[config.DefaultABIVersion] = eventABI
 }
 
-func generatePostedFileMsg(w *wallet.Wallet, q *uploader.Queue, chainID uint64, event PostedFile) (string, *evmTypes.ExecuteMsg, int64, error) {
-	log.Printf("Event details: %+v", event)
+func generatePostedFileMsg(env MsgEnv, event PostedFile) (string, *evmTypes.ExecuteMsg, int64, error) {
 	evmAddress := event.From.String()
 
 	merkleBase64, err := merkleToString(event.Merkle)
@@ -50,7 +50,7 @@ func generatePostedFileMsg(w *wallet.Wallet, q *uploader.Queue, chainID uint64,
 		return evmAddress, nil, 0, err
 	}
 
-	abci, err := w.Client.RPCClient.ABCIInfo(context.Background())
+	abci, err := env.Wallet.Client.RPCClient.ABCIInfo(context.Background())
 	if err != nil {
 		log.Printf("Failed to query ABCI: %v", err)
 		return evmAddress, nil, 0, err
@@ -63,7 +63,7 @@ func generatePostedFileMsg(w *wallet.Wallet, q *uploader.Queue, chainID uint64,
 		return evmAddress, nil, 0, err
 	}
 
-	note["relayed"] = map[string]any{"chain_id": chainRep(chainID), "for": evmAddress}
+	note["relayed"] = map[string]any{"chain_id": chainRep(env.ChainID), "for": evmAddress}
 	newNote, err := json.Marshal(note)
 	if err != nil {
 		log.Printf("Failed to add memo: %v", err)
@@ -91,12 +91,14 @@ func generatePostedFileMsg(w *wallet.Wallet, q *uploader.Queue, chainID uint64,
 		},
 	}
 
-	cost := int64(float64(q.GetCost(fileSize*maxProofs, int64(event.Expires)*24)) * 1.2)
+	cost, err := env.Queue.GetCost(fileSize*maxProofs, int64(event.Expires)*24)
+	if err != nil {
+		return evmAddress, nil, 0, err
+	}
 	return evmAddress, &relayedMsg, cost, nil
 }
 
-func generateBoughtStorageMsg(q *uploader.Queue, event BoughtStorage) (string, *evmTypes.ExecuteMsg, int64) {
-	log.Printf("Event details: %+v", event)
+func generateBoughtStorageMsg(env MsgEnv, event BoughtStorage) (string, *evmTypes.ExecuteMsg, int64, error) {
 	evmAddress := event.From.String()
 
 	relayedMsg := evmTypes.ExecuteMsg{
@@ -104,22 +106,24 @@ func generateBoughtStorageMsg(q *uploader.Queue, event BoughtStorage) (string, *
 			ForAddress:   event.ForAddress,
 			DurationDays: int64(event.DurationDays),
 			Bytes:        int64(event.SizeBytes),
-			PaymentDenom: "ujkl",
+			PaymentDenom: uploader.PaymentDenom,
 			Referral:     event.Referral,
 		},
 	}
 
-	cost := int64(float64(q.GetCost(int64(event.SizeBytes), int64(event.DurationDays)*24)) * 1.2)
-	return evmAddress, &relayedMsg, cost
+	cost, err := env.Queue.GetCost(int64(event.SizeBytes), int64(event.DurationDays)*24)
+	if err != nil {
+		return evmAddress, nil, 0, err
+	}
+	return evmAddress, &relayedMsg, cost, nil
 }
 
-func generateDeletedFileMsg(event DeletedFile) (string, *evmTypes.ExecuteMsg, error) {
-	log.Printf("Event details: %+v", event)
+func generateDeletedFileMsg(_ MsgEnv, event DeletedFile) (string, *evmTypes.ExecuteMsg, int64, error) {
 	evmAddress := event.From.String()
 
 	merkleBase64, err := merkleToString(event.Merkle)
 	if err != nil {
-		return evmAddress, nil, err
+		return evmAddress, nil, 0, err
 	}
 
 	relayedMsg := evmTypes.ExecuteMsg{
@@ -128,16 +132,15 @@ func generateDeletedFileMsg(event DeletedFile) (string, *evmTypes.ExecuteMsg, er
 			Start:  int64(event.Start),
 		},
 	}
-	return evmAddress, &relayedMsg, nil
+	return evmAddress, &relayedMsg, 0, nil
 }
 
-func generateRequestedReportFormMsg(event RequestedReportForm) (string, *evmTypes.ExecuteMsg, error) {
-	log.Printf("Event details: %+v", event)
+func generateRequestedReportFormMsg(_ MsgEnv, event RequestedReportForm) (string, *evmTypes.ExecuteMsg, int64, error) {
 	evmAddress := event.From.String()
 
 	merkleBase64, err := merkleToString(event.Merkle)
 	if err != nil {
-		return evmAddress, nil, err
+		return evmAddress, nil, 0, err
 	}
 
 	relayedMsg := evmTypes.ExecuteMsg{
@@ -148,11 +151,10 @@ func generateRequestedReportFormMsg(event RequestedReportForm) (string, *evmType
 			Start:  int64(event.Start),
 		},
 	}
-	return evmAddress, &relayedMsg, nil
+	return evmAddress, &relayedMsg, 0, nil
 }
 
-func generatePostedKeyMsg(event PostedKey) (string, *evmTypes.ExecuteMsg) {
-	log.Printf("Event details: %+v", event)
+func generatePostedKeyMsg(_ MsgEnv, event PostedKey) (string, *evmTypes.ExecuteMsg, int64, error) {
 	evmAddress := event.From.String()
 
 	relayedMsg := evmTypes.ExecuteMsg{
@@ -160,11 +162,10 @@ func generatePostedKeyMsg(event PostedKey) (string, *evmTypes.ExecuteMsg) {
 			Key: event.Key,
 		},
 	}
-	return evmAddress, &relayedMsg
+	return evmAddress, &relayedMsg, 0, nil
 }
 
-func generateDeletedFileTreeMsg(event DeletedFileTree) (string, *evmTypes.ExecuteMsg) {
-	log.Printf("Event details: %+v", event)
+func generateDeletedFileTreeMsg(_ MsgEnv, event DeletedFileTree) (string, *evmTypes.ExecuteMsg, int64, error) {
 	evmAddress := event.From.String()
 
 	relayedMsg := evmTypes.ExecuteMsg{
@@ -173,11 +174,10 @@ func generateDeletedFileTreeMsg(event DeletedFileTree) (string, *evmTypes.Execut
 			Account:  event.Account,
 		},
 	}
-	return evmAddress, &relayedMsg
+	return evmAddress, &relayedMsg, 0, nil
 }
 
-func generateProvisionedFiletreeMsg(event ProvisionedFileTree) (string, *evmTypes.ExecuteMsg) {
-	log.Printf("Event details: %+v", event)
+func generateProvisionedFiletreeMsg(_ MsgEnv, event ProvisionedFileTree) (string, *evmTypes.ExecuteMsg, int64, error) {
 	evmAddress := event.From.String()
 
 	relayedMsg := evmTypes.ExecuteMsg{
@@ -187,11 +187,10 @@ func generateProvisionedFiletreeMsg(event ProvisionedFileTree) (string, *evmType
 			TrackingNumber: event.TrackingNumber,
 		},
 	}
-	return evmAddress, &relayedMsg
+	return evmAddress, &relayedMsg, 0, nil
 }
 
-func generatePostedFileTreeMsg(event PostedFileTree) (string, *evmTypes.ExecuteMsg) {
-	log.Printf("Event details: %+v", event)
+func generatePostedFileTreeMsg(_ MsgEnv, event PostedFileTree) (string, *evmTypes.ExecuteMsg, int64, error) {
 	evmAddress := event.From.String()
 
 	relayedMsg := evmTypes.ExecuteMsg{
@@ -205,11 +204,10 @@ func generatePostedFileTreeMsg(event PostedFileTree) (string, *evmTypes.ExecuteM
 			TrackingNumber: event.TrackingNumber,
 		},
 	}
-	return evmAddress, &relayedMsg
+	return evmAddress, &relayedMsg, 0, nil
 }
 
-func generateAddedViewersMsg(event AddedViewers) (string, *evmTypes.ExecuteMsg) {
-	log.Printf("Event details: %+v", event)
+func generateAddedViewersMsg(_ MsgEnv, event AddedViewers) (string, *evmTypes.ExecuteMsg, int64, error) {
 	evmAddress := event.From.String()
 
 	relayedMsg := evmTypes.ExecuteMsg{
@@ -220,11 +218,10 @@ func generateAddedViewersMsg(event AddedViewers) (string, *evmTypes.ExecuteMsg)
 			FileOwner:  event.FileOwner,
 		},
 	}
-	return evmAddress, &relayedMsg
+	return evmAddress, &relayedMsg, 0, nil
 }
 
-func generateRemovedViewersMsg(event RemovedViewers) (string, *evmTypes.ExecuteMsg) {
-	log.Printf("Event details: %+v", event)
+func generateRemovedViewersMsg(_ MsgEnv, event RemovedViewers) (string, *evmTypes.ExecuteMsg, int64, error) {
 	evmAddress := event.From.String()
 
 	relayedMsg := evmTypes.ExecuteMsg{
@@ -234,11 +231,10 @@ func generateRemovedViewersMsg(event RemovedViewers) (string, *evmTypes.ExecuteM
 			FileOwner: event.FileOwner,
 		},
 	}
-	return evmAddress, &relayedMsg
+	return evmAddress, &relayedMsg, 0, nil
 }
 
-func generateResetViewersMsg(event ResetViewers) (string, *evmTypes.ExecuteMsg) {
-	log.Printf("Event details: %+v", event)
+func generateResetViewersMsg(_ MsgEnv, event ResetViewers) (string, *evmTypes.ExecuteMsg, int64, error) {
 	evmAddress := event.From.String()
 
 	relayedMsg := evmTypes.ExecuteMsg{
@@ -247,11 +243,10 @@ func generateResetViewersMsg(event ResetViewers) (string, *evmTypes.ExecuteMsg)
 			FileOwner: event.FileOwner,
 		},
 	}
-	return evmAddress, &relayedMsg
+	return evmAddress, &relayedMsg, 0, nil
 }
 
-func generateChangedOwnerMsg(event ChangedOwner) (string, *evmTypes.ExecuteMsg) {
-	log.Printf("Event details: %+v", event)
+func generateChangedOwnerMsg(_ MsgEnv, event ChangedOwner) (string, *evmTypes.ExecuteMsg, int64, error) {
 	evmAddress := event.From.String()
 
 	relayedMsg := evmTypes.ExecuteMsg{
@@ -261,11 +256,10 @@ func generateChangedOwnerMsg(event ChangedOwner) (string, *evmTypes.ExecuteMsg)
 			NewOwner:  event.NewOwner,
 		},
 	}
-	return evmAddress, &relayedMsg
+	return evmAddress, &relayedMsg, 0, nil
 }
 
-func generateAddedEditorsMsg(event AddedEditors) (string, *evmTypes.ExecuteMsg) {
-	log.Printf("Event details: %+v", event)
+func generateAddedEditorsMsg(_ MsgEnv, event AddedEditors) (string, *evmTypes.ExecuteMsg, int64, error) {
 	evmAddress := event.From.String()
 
 	relayedMsg := evmTypes.ExecuteMsg{
@@ -276,11 +270,10 @@ func generateAddedEditorsMsg(event AddedEditors) (string, *evmTypes.ExecuteMsg)
 			FileOwner:  event.FileOwner,
 		},
 	}
-	return evmAddress, &relayedMsg
+	return evmAddress, &relayedMsg, 0, nil
 }
 
-func generateRemovedEditorsMsg(event RemovedEditors) (string, *evmTypes.ExecuteMsg) {
-	log.Printf("Event details: %+v", event)
+func generateRemovedEditorsMsg(_ MsgEnv, event RemovedEditors) (string, *evmTypes.ExecuteMsg, int64, error) {
 	evmAddress := event.From.String()
 
 	relayedMsg := evmTypes.ExecuteMsg{
@@ -290,11 +283,10 @@ func generateRemovedEditorsMsg(event RemovedEditors) (string, *evmTypes.ExecuteM
 			FileOwner: event.FileOwner,
 		},
 	}
-	return evmAddress, &relayedMsg
+	return evmAddress, &relayedMsg, 0, nil
 }
 
-func generateResetEditorsMsg(event ResetEditors) (string, *evmTypes.ExecuteMsg) {
-	log.Printf("Event details: %+v", event)
+func generateResetEditorsMsg(_ MsgEnv, event ResetEditors) (string, *evmTypes.ExecuteMsg, int64, error) {
 	evmAddress := event.From.String()
 
 	relayedMsg := evmTypes.ExecuteMsg{
@@ -303,11 +295,10 @@ func generateResetEditorsMsg(event ResetEditors) (string, *evmTypes.ExecuteMsg)
 			FileOwner: event.FileOwner,
 		},
 	}
-	return evmAddress, &relayedMsg
+	return evmAddress, &relayedMsg, 0, nil
 }
 
-func generateCreatedNotificationMsg(event CreatedNotification) (string, *evmTypes.ExecuteMsg) {
-	log.Printf("Event details: %+v", event)
+func generateCreatedNotificationMsg(_ MsgEnv, event CreatedNotification) (string, *evmTypes.ExecuteMsg, int64, error) {
 	evmAddress := event.From.String()
 
 	relayedMsg := evmTypes.ExecuteMsg{
@@ -317,11 +308,10 @@ func generateCreatedNotificationMsg(event CreatedNotification) (string, *evmType
 			PrivateContents: event.PrivateContents,
 		},
 	}
-	return evmAddress, &relayedMsg
+	return evmAddress, &relayedMsg, 0, nil
 }
 
-func generateDeletedNotificationMsg(event DeletedNotification) (string, *evmTypes.ExecuteMsg) {
-	log.Printf("Event details: %+v", event)
+func generateDeletedNotificationMsg(_ MsgEnv, event DeletedNotification) (string, *evmTypes.ExecuteMsg, int64, error) {
 	evmAddress := event.From.String()
 
 	relayedMsg := evmTypes.ExecuteMsg{
@@ -330,11 +320,10 @@ func generateDeletedNotificationMsg(event DeletedNotification) (string, *evmType
 			Time: int64(event.Time),
 		},
 	}
-	return evmAddress, &relayedMsg
+	return evmAddress, &relayedMsg, 0, nil
 }
 
-func generateBlockedSendersMsg(event BlockedSenders) (string, *evmTypes.ExecuteMsg) {
-	log.Printf("Event details: %+v", event)
+func generateBlockedSendersMsg(_ MsgEnv, event BlockedSenders) (string, *evmTypes.ExecuteMsg, int64, error) {
 	evmAddress := event.From.String()
 
 	relayedMsg := evmTypes.ExecuteMsg{
@@ -342,216 +331,263 @@ func generateBlockedSendersMsg(event BlockedSenders) (string, *evmTypes.ExecuteM
 			ToBlock: event.ToBlock,
 		},
 	}
-	return evmAddress, &relayedMsg
+	return evmAddress, &relayedMsg, 0, nil
+}
+
+// relayedEvent is a bridge event decoded into the message it executes on Jackal
+type relayedEvent struct {
+	MessageType string
+	EvmAddress  string
+	Msg         *evmTypes.ExecuteMsg
+	Cost        int64
 }
 
-func handleLog(vLog *types.Log, w *wallet.Wallet, wEth *hdwallet.Wallet, q *uploader.Queue, chainID uint64, RPC string, jackalContract string, castPath string) {
+// FactoryMsg wraps the message so the factory contract executes it through the bindings of the EVM address
+func (e *relayedEvent) FactoryMsg() evmTypes.ExecuteFactoryMsg {
+	evmAddress := e.EvmAddress
+	return evmTypes.ExecuteFactoryMsg{
+		CallBindings: &evmTypes.ExecuteMsgCallBindings{
+			EvmAddress: &evmAddress,
+			Msg:        e.Msg,
+		},
+	}
+}
+
+// MessageID is the id the bridge contract stored the message under, see Jackal.newMessage
+func (e *relayedEvent) MessageID(blockNumber uint64) string {
+	return e.MessageType + strings.ToLower(e.EvmAddress) + strconv.FormatUint(blockNumber, 10)
+}
+
+// decodeLog unpacks a bridge event and builds the Jackal message for it
+func decodeLog(events *eventRegistries, vLog *types.Log, w *wallet.Wallet, q *uploader.Queue, chainID uint64) (*relayedEvent, error) {
 	// https://goethereumbook.org/event-read/#topics
-	eventSig := vLog.Topics[0].Hex()
 	fmt.Printf("index: %d | topics: %d\n", vLog.Index, len(vLog.Topics))
 	for _, topic := range vLog.Topics {
 		fmt.Printf("%s | %s\n", topic.Hex(), topic.String())
 	}
-	var messageType string
-	var errUnpack error
-	var errGenerate error
-	var msg *evmTypes.ExecuteMsg
-	var evmAddress string
-	var cost int64
-	switch eventSig {
-	case expectedSig("PostedFile(address,string,uint64,string,uint64)"):
-		messageType = "PostedFile"
-		eventPostedFile := PostedFile{}
-		errUnpack = eventABI.UnpackIntoInterface(&eventPostedFile, messageType, vLog.Data)
-		evmAddress, msg, cost, errGenerate = generatePostedFileMsg(w, q, chainID, eventPostedFile)
-	case expectedSig("BoughtStorage(address,string,uint64,uint64,string)"):
-		messageType = "BoughtStorage"
-		eventBoughtStorage := BoughtStorage{}
-		errUnpack = eventABI.UnpackIntoInterface(&eventBoughtStorage, messageType, vLog.Data)
-		evmAddress, msg, cost = generateBoughtStorageMsg(q, eventBoughtStorage)
-	case expectedSig("DeletedFile(address,string,uint64)"):
-		messageType = "DeletedFile"
-		eventDeletedFile := DeletedFile{}
-		errUnpack = eventABI.UnpackIntoInterface(&eventDeletedFile, messageType, vLog.Data)
-		evmAddress, msg, errGenerate = generateDeletedFileMsg(eventDeletedFile)
-	case expectedSig("RequestedReportForm(address,string,string,string,uint64)"):
-		messageType = "RequestedReportForm"
-		eventRequestedReportForm := RequestedReportForm{}
-		errUnpack = eventABI.UnpackIntoInterface(&eventRequestedReportForm, messageType, vLog.Data)
-		evmAddress, msg, errGenerate = generateRequestedReportFormMsg(eventRequestedReportForm)
-	case expectedSig("PostedKey(address,string)"):
-		messageType = "PostedKey"
-		eventPostedKey := PostedKey{}
-		errUnpack = eventABI.UnpackIntoInterface(&eventPostedKey, messageType, vLog.Data)
-		evmAddress, msg = generatePostedKeyMsg(eventPostedKey)
-	case expectedSig("DeletedFileTree(address,string,string)"):
-		messageType = "DeletedFileTree"
-		eventDeletedFileTree := DeletedFileTree{}
-		errUnpack = eventABI.UnpackIntoInterface(&eventDeletedFileTree, messageType, vLog.Data)
-		evmAddress, msg = generateDeletedFileTreeMsg(eventDeletedFileTree)
-	case expectedSig("ProvisionedFileTree(address,string,string,string)"):
-		messageType = "ProvisionedFileTree"
-		eventProvisionedFileTree := ProvisionedFileTree{}
-		errUnpack = eventABI.UnpackIntoInterface(&eventProvisionedFileTree, messageType, vLog.Data)
-		evmAddress, msg = generateProvisionedFiletreeMsg(eventProvisionedFileTree)
-	case expectedSig("PostedFileTree(address,string,string,string,string,string,string,string)"):
-		messageType = "PostedFileTree"
-		eventPostedFileTree := PostedFileTree{}
-		errUnpack = eventABI.UnpackIntoInterface(&eventPostedFileTree, messageType, vLog.Data)
-		evmAddress, msg = generatePostedFileTreeMsg(eventPostedFileTree)
-	case expectedSig("AddedViewers(address,string,string,string,string)"):
-		messageType = "AddedViewers"
-		eventAddedViewers := AddedViewers{}
-		errUnpack = eventABI.UnpackIntoInterface(&eventAddedViewers, messageType, vLog.Data)
-		evmAddress, msg = generateAddedViewersMsg(eventAddedViewers)
-	case expectedSig("RemovedViewers(address,string,string,string)"):
-		messageType = "RemovedViewers"
-		eventRemovedViewers := RemovedViewers{}
-		errUnpack = eventABI.UnpackIntoInterface(&eventRemovedViewers, messageType, vLog.Data)
-		evmAddress, msg = generateRemovedViewersMsg(eventRemovedViewers)
-	case expectedSig("ResetViewers(address,string,string)"):
-		messageType = "ResetViewers"
-		eventResetViewers := ResetViewers{}
-		errUnpack = eventABI.UnpackIntoInterface(&eventResetViewers, messageType, vLog.Data)
-		evmAddress, msg = generateResetViewersMsg(eventResetViewers)
-	case expectedSig("ChangedOwner(address,string,string,string)"):
-		messageType = "ChangedOwner"
-		eventChangedOwner := ChangedOwner{}
-		errUnpack = eventABI.UnpackIntoInterface(&eventChangedOwner, messageType, vLog.Data)
-		evmAddress, msg = generateChangedOwnerMsg(eventChangedOwner)
-	case expectedSig("AddedEditors(address,string,string,string,string)"):
-		messageType = "AddedEditors"
-		eventAddedEditors := AddedEditors{}
-		errUnpack = eventABI.UnpackIntoInterface(&eventAddedEditors, messageType, vLog.Data)
-		evmAddress, msg = generateAddedEditorsMsg(eventAddedEditors)
-	case expectedSig("RemovedEditors(address,string,string,string)"):
-		messageType = "RemovedEditors"
-		eventRemovedEditors := RemovedEditors{}
-		errUnpack = eventABI.UnpackIntoInterface(&eventRemovedEditors, messageType, vLog.Data)
-		evmAddress, msg = generateRemovedEditorsMsg(eventRemovedEditors)
-	case expectedSig("ResetEditors(address,string,string)"):
-		messageType = "ResetEditors"
-		eventResetEditors := ResetEditors{}
-		errUnpack = eventABI.UnpackIntoInterface(&eventResetEditors, messageType, vLog.Data)
-		evmAddress, msg = generateResetEditorsMsg(eventResetEditors)
-	case expectedSig("CreatedNotification(address,string,string,string)"):
-		messageType = "CreatedNotification"
-		eventCreatedNotification := CreatedNotification{}
-		errUnpack = eventABI.UnpackIntoInterface(&eventCreatedNotification, messageType, vLog.Data)
-		evmAddress, msg = generateCreatedNotificationMsg(eventCreatedNotification)
-	case expectedSig("DeletedNotification(address,string,uint64)"):
-		messageType = "DeletedNotification"
-		eventDeletedNotification := DeletedNotification{}
-		errUnpack = eventABI.UnpackIntoInterface(&eventDeletedNotification, messageType, vLog.Data)
-		evmAddress, msg = generateDeletedNotificationMsg(eventDeletedNotification)
-	case expectedSig("BlockedSenders(address,string[])"):
-		messageType = "BlockedSenders"
-		eventBlockedSenders := BlockedSenders{}
-		errUnpack = eventABI.UnpackIntoInterface(&eventBlockedSenders, messageType, vLog.Data)
-		evmAddress, msg = generateBlockedSendersMsg(eventBlockedSenders)
-	default:
-		log.Fatal("Failed to unpack log data into any event type")
+
+	h, ok := events.get(chainID, *vLog)
+	if !ok {
+		if len(vLog.Topics) == 0 {
+			return nil, relayError(StageDecode, "anonymous event", ErrUnknownEvent)
+		}
+		return nil, relayError(StageDecode, vLog.Topics[0].Hex(), ErrUnknownEvent)
 	}
+	name := eventName(h)
 
-	if errUnpack != nil || errGenerate != nil {
-		log.Fatalf("Failed to unpack event %v: %v %v", eventSig, errUnpack, errGenerate)
+	event, err := h.Decode(*vLog)
+	if err != nil {
+		return nil, relayError(StageDecode, name, err)
+	}
+	log.Printf("Event details: %+v", event)
+
+	evmAddress, msg, cost, err := h.BuildMsg(MsgEnv{Wallet: w, Queue: q, ChainID: chainID}, event)
+	if err != nil {
+		return nil, relayError(StageDecode, name, err)
 	}
 
 	fmt.Println("message: ")
 	fmt.Println(msg)
 
-	factoryMsg := evmTypes.ExecuteFactoryMsg{
-		CallBindings: &evmTypes.ExecuteMsgCallBindings{
-			EvmAddress: &evmAddress,
-			Msg:        msg,
-		},
-	}
+	return &relayedEvent{
+		MessageType: name,
+		EvmAddress:  evmAddress,
+		Msg:         msg,
+		Cost:        cost,
+	}, nil
+}
 
-	executeContractMessage := &wasm.MsgExecuteContract{
+// executeMsg builds the Jackal transaction message for a decoded event
+func executeMsg(event *relayedEvent, w *wallet.Wallet, jackalContract string) *wasm.MsgExecuteContract {
+	factoryMsg := event.FactoryMsg()
+	return &wasm.MsgExecuteContract{
 		Sender:   w.AccAddress(),
 		Contract: jackalContract,
 		Msg:      factoryMsg.Encode(),
-		Funds:    sdk.NewCoins(sdk.NewInt64Coin("ujkl", cost)),
+		Funds:    sdk.NewCoins(sdk.NewInt64Coin(uploader.PaymentDenom, event.Cost)),
 	}
+}
 
-	log.Printf("execute msg: %v", executeContractMessage)
-	if err := executeContractMessage.ValidateBasic(); err != nil {
-		log.Fatalf("Failed to validate message: %v", err)
-		return
+// handleLog relays a log to Jackal and only finishes the message on the EVM side once it executed successfully.
+// Every step is recorded in the write-ahead log first, so a log that is handled again picks up where it stopped.
+func handleLog(ctx context.Context, events *eventRegistries, journal *wal, bridge *bridgeReader, vLog *types.Log, w *wallet.Wallet, q *uploader.Queue, chainID uint64, jackalContract string) error {
+	entry := journal.get(chainID, *vLog)
+	switch entry.State {
+	case walFinished:
+		log.Printf("Log %d of tx %s was already relayed in %s", vLog.Index, vLog.TxHash.Hex(), entry.TxHash)
+		return nil
+	case walSkipped:
+		log.Printf("Log %d of tx %s was skipped, its message is no longer pending", vLog.Index, vLog.TxHash.Hex())
+		return nil
 	}
 
-	res, err := q.Post(executeContractMessage)
+	event, err := decodeLog(events, vLog, w, q, chainID)
 	if err != nil {
-		log.Fatalf("Failed to post message: %v", err)
-		return
+		return err
 	}
-	if res == nil {
-		log.Printf("Response is empty")
-		return
+
+	messageID := event.MessageID(vLog.BlockNumber)
+	state := entry.State
+	if state == walBroadcast {
+		state, err = resolveBroadcast(ctx, journal, q, chainID, vLog, messageID, entry.TxHash)
+		if err != nil {
+			return relayError(StagePost, event.MessageType, err)
+		}
 	}
 
-	log.Println(res.RawLog)
-	log.Println(res.TxHash)
+	if len(state) == 0 {
+		err = bridge.turn(ctx, vLog.BlockNumber, messageID, logSender(*vLog))
+		if err != nil {
+			return err
+		}
+	}
 
-	// Derive ETH account
-	account, err := wEth.Derive(hdwallet.MustParseDerivationPath("m/44'/60'/0'/0/0"), false)
-	if err != nil {
-		log.Printf("Failed to derive account: %v", err)
-		return
+	if state != walCommitted {
+		// refunded messages and messages another relay finished must not be paid for again. Finishing a message
+		// here took entries of the other logs that share its ID out of the array, those are read as they were
+		// pending right before.
+		var messages []bridgeMessage
+		if finished := journal.finishedIn(chainID, vLog.Address, messageID); finished > 0 {
+			messages, err = bridge.messagesAt(ctx, vLog.Address, messageID, finished-1)
+		} else {
+			messages, err = bridge.messages(ctx, vLog, messageID)
+		}
+		hasMessages := !errors.Is(err, errNoMethod)
+		if err != nil && hasMessages {
+			return relayError(StageValidate, event.MessageType, err)
+		}
+		if hasMessages && len(messages) == 0 {
+			log.Printf("Message %s is no longer pending on %s, skipping it", messageID, vLog.Address.Hex())
+			err = journal.set(chainID, *vLog, messageID, walSkipped, "")
+			if err != nil {
+				log.Printf("Failed to record skipped message: %v", err)
+			}
+			return nil
+		}
+
+		// a message that was queued before went through the check already
+		if state != walQueued {
+			err = bridge.checkPayment(ctx, vLog, event, messages)
+			if err != nil {
+				return relayError(StageValidate, event.MessageType, err)
+			}
+		}
+
+		err = postEvent(ctx, journal, q, chainID, vLog, event, w, jackalContract)
+		if err != nil {
+			return err
+		}
 	}
 
-	// Generate privkey
-	privKey, err := wEth.PrivateKeyHex(account)
-	if err != nil {
-		log.Printf("Failed to generate privkey: %v", err)
-		return
+	// Callback on EVM chain, fees are bumped while it is stuck. A batched message stays committed in the
+	// write-ahead log until its batch went out.
+	l := *vLog
+	done := func(receipt *types.Receipt, err error) {
+		recordFinish(journal, chainID, l, messageID, receipt, err)
+	}
+	if bridge.queueFinish(vLog.Address, messageID, done) {
+		return nil
 	}
+	finishCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), finishTimeout)
+	receipt, err := bridge.finishMessage(finishCtx, vLog.Address, messageID)
+	cancel()
+	done(receipt, err)
+	return nil
+}
 
-	// Callback on EVM chain
-	log.Printf("Starting mock execution")
-	messageID := messageType + strings.ToLower(evmAddress) + strconv.FormatUint(vLog.BlockNumber, 10)
-	success := callCast(RPC, privKey, vLog.Address.Hex(), "finishMessage(string)", messageID, castPath)
-	if !success {
-		time.Sleep(10 * time.Second)
-		success = callCast(RPC, privKey, vLog.Address.Hex(), "finishMessage(string)", messageID, castPath)
+// recordFinish records the outcome of the finishMessage call of a log
+func recordFinish(journal *wal, chainID uint64, l types.Log, messageID string, receipt *types.Receipt, err error) {
+	switch {
+	case errors.Is(err, errNoMethod):
+		// contracts registered without finishMessage have nothing to call back
+		log.Printf("%s has no finishMessage, message %s is done", l.Address.Hex(), messageID)
+	case err != nil:
+		// the message stays committed in the write-ahead log, finishing it is tried again on the next start
+		log.Printf("Failed to finish message %s: %v", messageID, err)
+		return
+	default:
+		log.Printf("Finished message %s in %s", messageID, receipt.TxHash.Hex())
 	}
 
-	if !success {
-		log.Printf("All attempts failed")
+	var finished uint64
+	if receipt != nil && receipt.BlockNumber != nil {
+		finished = receipt.BlockNumber.Uint64()
+	}
+	err = journal.finish(chainID, l, messageID, finished)
+	if err != nil {
+		log.Printf("Failed to record finished message: %v", err)
 	}
-	log.Printf("Mock execution complete")
 }
 
-func callCast(RPC string, privKey string, contract string, signature string, messageId string, castPath string) bool {
-	cmdArgs := []string{"send", "--rpc-url", RPC, "--private-key", privKey, contract, signature, messageId}
-	cmd := exec.Command(castPath, cmdArgs...)
-	log.Printf("Executing: %v", cmd.String())
+// postEvent executes the message of an event on Jackal, recording it as committed once it succeeded
+func postEvent(ctx context.Context, journal *wal, q *uploader.Queue, chainID uint64, vLog *types.Log, event *relayedEvent, w *wallet.Wallet, jackalContract string) error {
+	executeContractMessage := executeMsg(event, w, jackalContract)
+	messageID := event.MessageID(vLog.BlockNumber)
 
-	// Capture debugging outpot
-	var stdoutBuf, stderrBuf bytes.Buffer
-	cmd.Stdout = &stdoutBuf
-	cmd.Stderr = &stderrBuf
+	log.Printf("execute msg: %v", executeContractMessage)
+	if err := executeContractMessage.ValidateBasic(); err != nil {
+		return relayError(StageValidate, event.MessageType, fmt.Errorf("%w | %w", ErrInvalidMsg, err))
+	}
 
-	// Actually run command, logs errors if callback not executed
-	success := false
-	err := cmd.Run()
+	err := journal.set(chainID, *vLog, messageID, walQueued, "")
 	if err != nil {
-		log.Printf("Failed to run commanad: %v", err)
+		return relayError(StagePost, event.MessageType, err)
 	}
-	output := stdoutBuf.String() + stderrBuf.String()
 
-	// Extract the transaction hash if present
-	for _, line := range strings.Split(output, "\n") {
-		if strings.HasPrefix(line, "transactionHash") {
-			log.Printf("Tx: %v", strings.TrimSpace(strings.Fields(line)[1]))
-			break
-		} else if strings.HasPrefix(line, "status") { // detect successful transaction
-			success = strings.Contains(line, "1")
+	res, err := q.PostTracked(ctx, executeContractMessage, func(txHash string) {
+		err := journal.set(chainID, *vLog, messageID, walBroadcast, txHash)
+		if err != nil {
+			log.Printf("Failed to record broadcast: %v", err)
 		}
+	})
+	if errors.Is(err, uploader.ErrStopped) {
+		return err
+	}
+	if err != nil {
+		// a message known not to be executed on Jackal is handed over to the dead letters, one that may still be
+		// executed keeps its broadcast state so it is looked up before it is posted again
+		if errors.Is(err, uploader.ErrNotPosted) || errors.Is(err, uploader.ErrSimulation) || errors.Is(err, uploader.ErrTxFailed) {
+			errForget := journal.set(chainID, *vLog, messageID, walForgotten, "")
+			if errForget != nil {
+				log.Printf("Failed to record failed message: %v", errForget)
+			}
+		}
+		return relayError(StagePost, event.MessageType, err)
+	}
+	if res == nil {
+		return relayError(StagePost, event.MessageType, errors.New("response is empty"))
+	}
+	if res.Code != 0 {
+		return relayError(StagePost, event.MessageType, fmt.Errorf("tx %s failed with code %d | %s | %w", res.TxHash, res.Code, res.RawLog, uploader.ErrTxFailed))
+	}
+
+	log.Println(res.RawLog)
+	log.Println(res.TxHash)
+
+	err = journal.set(chainID, *vLog, messageID, walCommitted, res.TxHash)
+	if err != nil {
+		log.Printf("Failed to record committed message: %v", err)
 	}
+	return nil
+}
 
-	log.Printf("Executed command: %v", output)
-	return success
+// resolveBroadcast finds out if a message that was broadcast before a restart made it on Jackal
+func resolveBroadcast(ctx context.Context, journal *wal, q *uploader.Queue, chainID uint64, vLog *types.Log, messageID string, txHash string) (walState, error) {
+	res, err := q.Lookup(ctx, txHash)
+	if errors.Is(err, uploader.ErrTxFailed) || (err == nil && res == nil) {
+		log.Printf("Message of log %d of tx %s is not on Jackal, posting it again", vLog.Index, vLog.TxHash.Hex())
+		return walQueued, nil
+	}
+	if err != nil {
+		return walBroadcast, fmt.Errorf("cannot look up tx %s | %w", txHash, err)
+	}
+
+	log.Printf("Message of log %d of tx %s was executed in %s", vLog.Index, vLog.TxHash.Hex(), txHash)
+	err = journal.set(chainID, *vLog, messageID, walCommitted, txHash)
+	if err != nil {
+		return walBroadcast, err
+	}
+	return walCommitted, nil
 }
 
 func chainRep(id uint64) string {
@@ -570,7 +606,3 @@ func merkleToString(merkle string) (string, error) {
 	}
 	return base64.StdEncoding.EncodeToString(merkleRoot), nil
 }
-
-func expectedSig(function string) string {
-	return crypto.Keccak256Hash([]byte(function)).Hex()
-}
@@ -5,11 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	_ "os/signal"
 	"path"
 	"strings"
 	"sync"
-	_ "syscall"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -21,35 +19,116 @@ import (
 	jWallet "github.com/JackalLabs/mulberry/jackal/wallet"
 	"github.com/cosmos/go-bip39"
 	walletTypes "github.com/desmos-labs/cosmos-go-wallet/types"
-	"github.com/ethereum/go-ethereum"
-	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/accounts/abi"
 	hdwallet "github.com/miguelmota/go-ethereum-hdwallet"
 	"github.com/spf13/viper"
 )
 
+const (
+	defaultShutdownTimeout = 30 * time.Second
+	defaultPostTimeout     = 5 * time.Minute
+)
+
 func initLogger() {
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	log.Logger = log.With().Caller().Logger()
 	log.Logger = log.Level(zerolog.DebugLevel)
 }
 
-func (a *App) Start() error {
+// Start relays every configured network until ctx is done, then shuts down gracefully.
+// Logs and queued Jackal messages in flight are given the shutdown timeout to finish.
+func (a *App) Start(ctx context.Context) error {
+	a.started.Store(true)
+
+	err := a.loadEvents()
+	if err != nil {
+		return fmt.Errorf("the relay does not match the contract ABI | %w", err)
+	}
+
+	err = a.lockWAL()
+	if err != nil {
+		return err
+	}
+	defer a.unlockWAL()
+
+	err = a.updatePricing(ctx)
+	if err != nil {
+		return err
+	}
 	a.q.Listen()
 
+	stopCtx, cancel := shutdownContext(ctx, a.shutdownTimeout())
+	defer cancel()
+
 	var wg sync.WaitGroup
+	errs := make([]error, len(a.cfg.NetworksConfig))
 
-	for _, networkConfig := range a.cfg.NetworksConfig {
+	for i, networkConfig := range a.cfg.NetworksConfig {
 		wg.Add(1)
-		go a.ListenToEthereumNetwork(networkConfig, &wg)
+		go func(i int, networkConfig config.NetworkConfig) {
+			defer wg.Done()
+			errs[i] = a.ListenToEthereumNetwork(ctx, stopCtx, networkConfig)
+		}(i, networkConfig)
 	}
 
 	wg.Wait()
 
+	err = a.q.Stop(stopCtx)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("cannot drain the jackal queue | %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// updatePricing reads the JKL price and the storage params once, paid logs can't be relayed before both are known
+func (a *App) updatePricing(ctx context.Context) error {
+	err := a.q.UpdatePrice(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot get jackal price | %w", err)
+	}
+	err = a.q.UpdateStorageParams(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot get jackal storage params | %w", err)
+	}
 	return nil
 }
 
+func (a *App) shutdownTimeout() time.Duration {
+	if a.cfg.MulberrySettings.ShutdownTimeout == 0 {
+		return defaultShutdownTimeout
+	}
+	return time.Duration(a.cfg.MulberrySettings.ShutdownTimeout) * time.Second
+}
+
+func (a *App) postTimeout() time.Duration {
+	if a.cfg.MulberrySettings.PostTimeout == 0 {
+		return defaultPostTimeout
+	}
+	return time.Duration(a.cfg.MulberrySettings.PostTimeout) * time.Second
+}
+
+// shutdownContext returns a context that is done once the timeout has passed after ctx is done
+func shutdownContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	stopCtx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stopCtx.Done():
+			return
+		}
+
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		select {
+		case <-t.C:
+			cancel()
+		case <-stopCtx.Done():
+		}
+	}()
+	return stopCtx, cancel
+}
+
 func MakeApp(homePath string) (*App, error) {
 	_, err := os.Stat(homePath)
 	if err != nil {
@@ -95,6 +174,28 @@ func MakeApp(homePath string) (*App, error) {
 		return nil, fmt.Errorf("cannot unmarshal the config | %w", err)
 	}
 
+	for _, network := range cfg.NetworksConfig {
+		err = network.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid network config | %w", err)
+		}
+	}
+
+	err = cfg.MulberrySettings.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid mulberry settings | %w", err)
+	}
+
+	err = cfg.JackalConfig.Price.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid price config | %w", err)
+	}
+
+	err = cfg.JackalConfig.Fees.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid fee config | %w", err)
+	}
+
 	initLogger()
 
 	seedFile := cfg.JackalConfig.SeedFile
@@ -144,7 +245,19 @@ func MakeApp(homePath string) (*App, error) {
 		return nil, err
 	}
 
-	q := uploader.NewQueue(w)
+	q := uploader.NewQueue(w, uploader.Options{
+		BatchSize:      cfg.JackalConfig.BatchSize,
+		FlushInterval:  time.Duration(cfg.JackalConfig.FlushInterval) * time.Millisecond,
+		MaxDepth:       cfg.JackalConfig.MaxQueueDepth,
+		Oracle:         priceOracle(cfg.JackalConfig.Price, homePath),
+		PriceInterval:  time.Duration(cfg.JackalConfig.Price.Interval) * time.Second,
+		MaxPriceAge:    time.Duration(cfg.JackalConfig.Price.MaxAge) * time.Second,
+		ParamsInterval: time.Duration(cfg.JackalConfig.ParamsInterval) * time.Second,
+		Fees: uploader.FeePolicy{
+			Markup:  cfg.JackalConfig.Fees.Markup,
+			FlatFee: cfg.JackalConfig.Fees.FlatFee,
+		},
+	})
 
 	// Ethereum wallet
 	wEth, err := hdwallet.NewFromMnemonic(mnemonic)
@@ -159,57 +272,54 @@ func MakeApp(homePath string) (*App, error) {
 	}
 	fmt.Printf("Mulberry EVM address: %v\n", account.Address.Hex())
 
+	key, err := wEth.PrivateKey(account)
+	if err != nil {
+		return nil, err
+	}
+
+	coord, err := newCoordinator(cfg.MulberrySettings, account.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay set | %w", err)
+	}
+
 	app := App{
-		w:    w,
-		wEth: wEth,
-		q:    q,
-		cfg:  cfg,
+		w:      w,
+		sender: newEVMSender(key),
+		q:      q,
+		cfg:    cfg,
+		home:   homePath,
+		coord:  coord,
+		abis:   make(map[string]abi.ABI),
 	}
 
 	return &app, nil
 }
 
-func subscribeLogs(client *ethclient.Client, query ethereum.FilterQuery) (ethereum.Subscription, chan types.Log, error) {
-	logs := make(chan types.Log)
-	sub, err := client.SubscribeFilterLogs(context.Background(), query, logs)
-	return sub, logs, err
-}
-
-// waitForReceipt polls for the transaction receipt until it's available
-func waitForReceipt(client *ethclient.Client, txHash common.Hash, network config.NetworkConfig, callBack func(receipt *types.Receipt)) error {
-	subLogger := log.With().Str("network", network.Name).Logger()
-
-	var errCount int64
-	for {
-		if errCount > 30 {
-			return errors.New("cannot get receipt")
-		}
-
-		time.Sleep(3 * time.Second)
-		receipt, err := client.TransactionReceipt(context.Background(), txHash)
-		if err != nil {
-			subLogger.Printf("cannot get receipt from network | %s", err.Error())
-			errCount++
-			continue
-		}
-
-		latestBlock, err := client.BlockNumber(context.Background())
-		if err != nil {
-			subLogger.Printf("cannot get current height | %s", err.Error())
-			errCount++
-			continue
+// priceOracle combines the configured price sources, falling back to CoinGecko alone
+func priceOracle(cfg config.PriceConfig, homePath string) uploader.PriceOracle {
+	var sources []uploader.PriceOracle
+	if cfg.CoinGecko || len(cfg.CoinGeckoURL) > 0 {
+		sources = append(sources, uploader.NewGeckoOracle(cfg.CoinGeckoURL))
+	}
+	if cfg.Static > 0 {
+		sources = append(sources, uploader.StaticOracle{Price: cfg.Static})
+	}
+	for _, feed := range cfg.Feeds {
+		if !strings.HasPrefix(feed, "http://") && !strings.HasPrefix(feed, "https://") && !path.IsAbs(feed) {
+			feed = path.Join(homePath, feed)
 		}
+		sources = append(sources, uploader.NewFeedOracle(feed))
+	}
 
-		txBlock := receipt.BlockNumber.Uint64()
-
-		blockDiff := latestBlock - txBlock
-		if blockDiff >= network.Finality {
-			callBack(receipt)
-			return nil
-		} else {
-			subLogger.Printf("Still waiting %d more blocks for %s on %d...", network.Finality-blockDiff, txHash.String(), network.ChainID)
-		}
+	if len(sources) == 0 {
+		return uploader.NewGeckoOracle(cfg.CoinGeckoURL)
+	}
+	maxAge := time.Duration(cfg.MaxAge) * time.Second
+	if maxAge == 0 {
+		maxAge = uploader.DefaultMaxPriceAge
 	}
+	// sources past the max age are left out so one stale feed doesn't stop the others
+	return uploader.MedianOracle{Sources: sources, MaxAge: maxAge}
 }
 
 func (a *App) Address() string {
@@ -0,0 +1,270 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/JackalLabs/mulberry/config"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// errNoMethod is returned when the ABI of a contract doesn't have a function the relay reads
+var errNoMethod = errors.New("the contract ABI has no such function")
+
+// messagesPage is the number of entries of the messages array read per batch
+const messagesPage = 32
+
+// bridgeReader reads the state of the bridge contracts of a network, each with its own ABI
+type bridgeReader struct {
+	a       *App
+	network config.NetworkConfig
+	rpcs    *endpointPool
+	// snapshots are the messages arrays read so far, a reader is shared by the logs of a network to share them too
+	snapshots *messageSnapshots
+	// coordinate leaves the messages of other relays to them until their turn is over
+	coordinate bool
+	// batcher sends finishMessage calls in batches, nil finishes each message on its own
+	batcher *finishBatcher
+}
+
+func (a *App) bridgeReader(network config.NetworkConfig, rpcs *endpointPool) *bridgeReader {
+	return &bridgeReader{a: a, network: network, rpcs: rpcs, snapshots: newMessageSnapshots()}
+}
+
+// coordinated returns a reader that follows the relay set, replays and retries asked for by hand don't
+func (b *bridgeReader) coordinated() *bridgeReader {
+	c := *b
+	c.coordinate = true
+	return &c
+}
+
+// method returns a function of the ABI a contract was configured with
+func (b *bridgeReader) method(contract common.Address, name string) (abi.Method, error) {
+	contractABI, ok := b.a.events.contractABI(b.network.ChainID, contract)
+	if !ok {
+		return abi.Method{}, fmt.Errorf("contract %s is not watched on %s", contract.Hex(), b.network.Name)
+	}
+	m, ok := contractABI.Methods[name]
+	if !ok {
+		return abi.Method{}, fmt.Errorf("%s on %s | %w", name, contract.Hex(), errNoMethod)
+	}
+	return m, nil
+}
+
+// call runs a view function of a contract at a block and returns its outputs
+func (b *bridgeReader) call(ctx context.Context, contract common.Address, block uint64, name string, args ...any) ([]any, error) {
+	m, err := b.method(contract, name)
+	if err != nil {
+		return nil, err
+	}
+	input, err := m.Inputs.Pack(args...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot pack %s | %w", name, err)
+	}
+
+	e, client, err := b.rpcs.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var res hexutil.Bytes
+	err = client.Client().CallContext(ctx, &res, "eth_call", callArgs(contract, append(m.ID, input...)), hexutil.EncodeBig(new(big.Int).SetUint64(block)))
+	b.rpcs.report(e, ignoreRevert(err))
+	if err != nil {
+		return nil, fmt.Errorf("cannot call %s on %s | %w", name, contract.Hex(), err)
+	}
+	return m.Outputs.Unpack(res)
+}
+
+// bridgeMessage is an entry of the messages array of a bridge contract
+type bridgeMessage struct {
+	ID string
+	// Value is the wei paid with the message, nil if the ABI of the contract doesn't have it
+	Value *big.Int
+}
+
+// messages returns the entries of the messages array of the contract that emitted a log that carry a message ID, at the latest block.
+// Messages leave the array once they are finished by a relay or refunded to the user. Contracts without a messages array return errNoMethod.
+func (b *bridgeReader) messages(ctx context.Context, vLog *types.Log, id string) ([]bridgeMessage, error) {
+	e, client, err := b.rpcs.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	head, err := client.BlockNumber(ctx)
+	b.rpcs.report(e, err)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get the latest block | %w", err)
+	}
+	return b.messagesAt(ctx, vLog.Address, id, head)
+}
+
+// messagesAt returns the entries of the messages array of a contract that carry a message ID at a block
+func (b *bridgeReader) messagesAt(ctx context.Context, contract common.Address, id string, block uint64) ([]bridgeMessage, error) {
+	all, err := b.snapshots.get(ctx, contract, block, b.readMessages)
+	if err != nil {
+		return nil, err
+	}
+	var found []bridgeMessage
+	for _, msg := range all {
+		if msg.ID == id {
+			found = append(found, msg)
+		}
+	}
+	return found, nil
+}
+
+// readMessages reads the whole messages array of a contract at a block, so entries moved around by a removal can't be missed
+func (b *bridgeReader) readMessages(ctx context.Context, contract common.Address, number uint64) ([]bridgeMessage, error) {
+	m, err := b.method(contract, "messages")
+	if err != nil {
+		return nil, err
+	}
+	value := -1
+	for i, output := range m.Outputs {
+		if output.Name == "value" {
+			value = i
+		}
+	}
+
+	e, client, err := b.rpcs.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	block := hexutil.EncodeBig(new(big.Int).SetUint64(number))
+
+	var all []bridgeMessage
+	for start := int64(0); ; start += messagesPage {
+		batch := make([]rpc.BatchElem, messagesPage)
+		results := make([]hexutil.Bytes, messagesPage)
+		for i := range batch {
+			input, err := m.Inputs.Pack(big.NewInt(start + int64(i)))
+			if err != nil {
+				return nil, fmt.Errorf("cannot pack messages | %w", err)
+			}
+			batch[i] = rpc.BatchElem{
+				Method: "eth_call",
+				Args:   []any{callArgs(contract, append(m.ID, input...)), block},
+				Result: &results[i],
+			}
+		}
+
+		err = client.Client().BatchCallContext(ctx, batch)
+		b.rpcs.report(e, err)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read messages of %s | %w", contract.Hex(), err)
+		}
+
+		for i, elem := range batch {
+			if elem.Error != nil {
+				// reading past the end of the array reverts, anything else means the array was not fully read
+				if !isRevert(elem.Error) {
+					return nil, fmt.Errorf("cannot read message %d of %s | %w", start+int64(i), contract.Hex(), elem.Error)
+				}
+				return all, nil
+			}
+
+			out, err := m.Outputs.Unpack(results[i])
+			if err != nil {
+				return nil, fmt.Errorf("cannot decode message %d of %s | %w", start+int64(i), contract.Hex(), err)
+			}
+			messageID, _ := out[0].(string)
+			msg := bridgeMessage{ID: messageID}
+			if value >= 0 {
+				msg.Value, _ = out[value].(*big.Int)
+			}
+			all = append(all, msg)
+		}
+	}
+}
+
+// messageSnapshots shares the messages array of a contract read at a block between the logs that need it,
+// instead of reading the whole array again for each of them
+type messageSnapshots struct {
+	mu        sync.Mutex
+	snapshots map[snapshotKey]*messageSnapshot
+}
+
+type snapshotKey struct {
+	contract common.Address
+	block    uint64
+}
+
+type messageSnapshot struct {
+	done     chan struct{}
+	messages []bridgeMessage
+	err      error
+}
+
+func newMessageSnapshots() *messageSnapshots {
+	return &messageSnapshots{snapshots: make(map[snapshotKey]*messageSnapshot)}
+}
+
+// get returns the snapshot of a contract at a block, reading it once with read. A snapshot replaces those of the
+// contract at lower blocks, failed reads are not kept.
+func (s *messageSnapshots) get(ctx context.Context, contract common.Address, block uint64, read func(context.Context, common.Address, uint64) ([]bridgeMessage, error)) ([]bridgeMessage, error) {
+	k := snapshotKey{contract: contract, block: block}
+
+	s.mu.Lock()
+	snap, ok := s.snapshots[k]
+	if !ok {
+		for other := range s.snapshots {
+			if other.contract == contract && other.block < block {
+				delete(s.snapshots, other)
+			}
+		}
+		snap = &messageSnapshot{done: make(chan struct{})}
+		s.snapshots[k] = snap
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		snap.messages, snap.err = read(ctx, contract, block)
+		if snap.err != nil {
+			s.mu.Lock()
+			if s.snapshots[k] == snap {
+				delete(s.snapshots, k)
+			}
+			s.mu.Unlock()
+		}
+		close(snap.done)
+	}
+
+	select {
+	case <-snap.done:
+		return snap.messages, snap.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func callArgs(to common.Address, data []byte) map[string]any {
+	return map[string]any{
+		"to":   to,
+		"data": hexutil.Bytes(data),
+	}
+}
+
+// isRevert reports if a call failed because the contract reverted rather than because of the node
+func isRevert(err error) bool {
+	var dataErr rpc.DataError
+	if errors.As(err, &dataErr) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "revert") || strings.Contains(msg, "invalid opcode")
+}
+
+// ignoreRevert keeps a reverted call from counting against the health of the endpoint that ran it
+func ignoreRevert(err error) error {
+	if err != nil && isRevert(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,297 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JackalLabs/mulberry/config"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// stubBridge serves the view functions of a v1 bridge contract, its messages array changing at given blocks
+type stubBridge struct {
+	mu   sync.Mutex
+	head uint64
+	// arrays is the messages array from each block on until the next one
+	arrays map[uint64][]bridgeMessage
+	// price is what getPrice returns, in USD with 8 decimals per ETH
+	price int64
+	// logs are what eth_getLogs returns
+	logs  []types.Log
+	reads int
+}
+
+func (s *stubBridge) methods() rpcMethods {
+	return rpcMethods{
+		"eth_blockNumber": func([]json.RawMessage) (any, error) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return hexutil.Uint64(s.head), nil
+		},
+		"eth_call":    s.call,
+		"eth_getLogs": returns(s.logs),
+	}
+}
+
+func (s *stubBridge) call(params []json.RawMessage) (any, error) {
+	var msg struct {
+		Data hexutil.Bytes `json:"data"`
+	}
+	var tag string
+	err := errors.Join(json.Unmarshal(params[0], &msg), json.Unmarshal(params[1], &tag))
+	if err != nil {
+		return nil, err
+	}
+	block, err := hexutil.DecodeUint64(tag)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected block %s", tag)
+	}
+
+	contractABI := abiVersions["v1"]
+	m, err := contractABI.MethodById(msg.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch m.Name {
+	case "getPrice":
+		return hexutil.Bytes(common.BigToHash(big.NewInt(s.price)).Bytes()), nil
+	case "messages":
+		s.reads++
+		args, err := m.Inputs.Unpack(msg.Data[4:])
+		if err != nil {
+			return nil, err
+		}
+		i := args[0].(*big.Int).Uint64()
+		array := s.array(block)
+		if i >= uint64(len(array)) {
+			return nil, errors.New("execution reverted")
+		}
+		value := array[i].Value
+		if value == nil {
+			value = new(big.Int)
+		}
+		out, err := m.Outputs.Pack(array[i].ID, common.Address{}, big.NewInt(int64(block)), value)
+		return hexutil.Bytes(out), err
+	}
+	return nil, fmt.Errorf("unexpected call to %s", m.Name)
+}
+
+// array returns the messages array at a block, must be called with the lock held
+func (s *stubBridge) array(block uint64) []bridgeMessage {
+	from := uint64(0)
+	var array []bridgeMessage
+	for b, a := range s.arrays {
+		if b <= block && b >= from {
+			from, array = b, a
+		}
+	}
+	return array
+}
+
+// testBridge returns a reader of the v1 contract of network served by rpcs
+func testBridge(t *testing.T, a *App, network config.NetworkConfig, rpcs rpcMethods) *bridgeReader {
+	contract := common.HexToAddress(network.Contract)
+	r, err := newEventRegistry(abiVersions["v1"], bridgeEvents, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.events = &eventRegistries{contracts: map[contractKey]*eventRegistry{{chainID: network.ChainID, address: contract}: r}}
+	return a.bridgeReader(network, stubRPC(t, rpcs))
+}
+
+func TestMessagesSnapshot(t *testing.T) {
+	a, network := testApp(t, rpcMethods{})
+	value := big.NewInt(1000)
+	s := &stubBridge{head: 10, arrays: map[uint64][]bridgeMessage{
+		0:  {{ID: "a", Value: value}, {ID: "b", Value: value}, {ID: "a", Value: value}},
+		11: {{ID: "b", Value: value}},
+	}}
+	b := testBridge(t, a, network, s.methods())
+	l := &types.Log{Address: common.HexToAddress(network.Contract)}
+
+	cases := []struct {
+		name  string
+		head  uint64
+		id    string
+		found int
+		reads int // messages calls so far
+	}{
+		{name: "read at the head", head: 10, id: "a", found: 2, reads: messagesPage},
+		{name: "another ID at the same head", head: 10, id: "b", found: 1, reads: messagesPage},
+		{name: "read again at a new head", head: 11, id: "a", found: 0, reads: 2 * messagesPage},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s.mu.Lock()
+			s.head = c.head
+			s.mu.Unlock()
+
+			found, err := b.messages(context.Background(), l, c.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(found) != c.found {
+				t.Errorf("found %d entries of %s, want %d", len(found), c.id, c.found)
+			}
+			for _, m := range found {
+				if m.ID != c.id || m.Value.Cmp(value) != 0 {
+					t.Errorf("found %+v", m)
+				}
+			}
+			if s.reads != c.reads {
+				t.Errorf("read %d entries, want %d", s.reads, c.reads)
+			}
+		})
+	}
+}
+
+func TestMessageSnapshotsShareReads(t *testing.T) {
+	snapshots := newMessageSnapshots()
+	contract := common.HexToAddress("0x1")
+	var mu sync.Mutex
+	reads := 0
+	fail := true
+	read := func(context.Context, common.Address, uint64) ([]bridgeMessage, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		reads++
+		time.Sleep(10 * time.Millisecond)
+		if fail {
+			return nil, errors.New("endpoint down")
+		}
+		return []bridgeMessage{{ID: "a"}}, nil
+	}
+
+	// a failed read is not kept
+	_, err := snapshots.get(context.Background(), contract, 10, read)
+	if err == nil {
+		t.Fatal("got a snapshot from a failed read")
+	}
+	fail = false
+
+	// logs asking while it is read wait for the same read
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			messages, err := snapshots.get(context.Background(), contract, 10, read)
+			if err != nil || len(messages) != 1 {
+				t.Errorf("got %v (%v), want the entry", messages, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if reads != 2 {
+		t.Fatalf("read %d times, want the failed read and one shared by the logs", reads)
+	}
+
+	_, err = snapshots.get(context.Background(), contract, 11, read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots.snapshots) != 1 {
+		t.Errorf("%d snapshots kept, want only the one of the latest block", len(snapshots.snapshots))
+	}
+}
+
+func TestHandleLogMessageSkip(t *testing.T) {
+	a, network := testApp(t, rpcMethods{})
+	err := a.updatePricing(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract := common.HexToAddress(network.Contract)
+	from := common.HexToAddress("0x00000000000000000000000000000000000000a1")
+
+	// two purchases of one sender in one block share a message ID
+	ev := abiVersions["v1"].Events["BoughtStorage"]
+	data, err := ev.Inputs.Pack(from, "jkl1user", uint64(30), uint64(1_000_000_000), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logAt := func(index uint) types.Log {
+		l := testLog(from, 5, index)
+		l.Address, l.Topics, l.Data = contract, []common.Hash{ev.ID}, data
+		return l
+	}
+	first, second := logAt(0), logAt(1)
+
+	b := testBridge(t, a, network, rpcMethods{})
+	event, err := decodeLog(a.events, &second, nil, a.q, network.ChainID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := event.MessageID(second.BlockNumber)
+
+	// the entries carry no value, a log that is still owed fails its payment check
+	cases := []struct {
+		name     string
+		finished uint64 // block the first log was finished in, 0 if it wasn't
+		arrays   map[uint64][]bridgeMessage
+		skipped  bool
+	}{
+		{name: "pending", arrays: map[uint64][]bridgeMessage{0: {{ID: id}, {ID: id}}}, skipped: false},
+		{name: "refunded", arrays: map[uint64][]bridgeMessage{0: {{ID: "other"}}}, skipped: true},
+		{
+			// finishing the first log took the entry of the second one with it
+			name:     "finished with another log",
+			finished: 8,
+			arrays:   map[uint64][]bridgeMessage{0: {{ID: id}, {ID: id}}, 8: {}},
+			skipped:  false,
+		},
+		{
+			// the entry swapped in while the first one was finished survived, it is not all that was paid
+			name:     "an entry survived finishing another log",
+			finished: 8,
+			arrays:   map[uint64][]bridgeMessage{0: {{ID: id}, {ID: id}}, 8: {{ID: id}}},
+			skipped:  false,
+		},
+		{
+			name:     "refunded before another log was finished",
+			finished: 8,
+			arrays:   map[uint64][]bridgeMessage{0: {{ID: id}, {ID: id}}, 6: {{ID: "other"}}, 8: {}},
+			skipped:  true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := &stubBridge{head: 10, arrays: c.arrays, price: 3000e8, logs: []types.Log{first, second}}
+			b.rpcs = stubRPC(t, s.methods())
+			b.snapshots = newMessageSnapshots()
+			journal, err := openWAL(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer journal.close()
+			if c.finished > 0 {
+				err = journal.finish(network.ChainID, first, id, c.finished)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = handleLog(context.Background(), a.events, journal, b, &second, nil, a.q, network.ChainID, "jkl1contract")
+			state := journal.get(network.ChainID, second).State
+			if c.skipped && (err != nil || state != walSkipped) {
+				t.Errorf("got %v in state %q, want the log skipped", err, state)
+			}
+			if !c.skipped && !errors.Is(err, ErrUnderpaid) {
+				t.Errorf("got %v in state %q, want the payment of the log checked", err, state)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/JackalLabs/mulberry/config"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+const defaultBackfillRange uint64 = 1000
+
+// checkpoint keeps track of the last block on a network for which every log has been relayed
+type checkpoint struct {
+	mu      sync.Mutex
+	path    string
+	block   uint64
+	scanned uint64
+	logs    map[logKey]*trackedLog
+}
+
+// logKey uniquely identifies a log on a network
+type logKey struct {
+	block common.Hash
+	tx    common.Hash
+	index uint
+}
+
+func keyOf(l types.Log) logKey {
+	return logKey{block: l.BlockHash, tx: l.TxHash, index: l.Index}
+}
+
+type trackedLog struct {
+	block uint64
+	done  bool
+}
+
+type checkpointFile struct {
+	Block uint64 `json:"block"`
+}
+
+// loadCheckpoint reads the checkpoint for a network from the home directory, a missing file starts at block 0
+func loadCheckpoint(homePath string, network config.NetworkConfig) (*checkpoint, error) {
+	dir := path.Join(homePath, "checkpoints")
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("cannot make the checkpoint directory at %s | %w", dir, err)
+	}
+
+	c := checkpoint{
+		path: path.Join(dir, fmt.Sprintf("%d.json", network.ChainID)),
+		logs: make(map[logKey]*trackedLog),
+	}
+
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &c, nil
+		}
+		return nil, fmt.Errorf("cannot read checkpoint at %s | %w", c.path, err)
+	}
+
+	var f checkpointFile
+	err = json.Unmarshal(data, &f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse checkpoint at %s | %w", c.path, err)
+	}
+
+	c.block = f.Block
+	c.scanned = f.Block
+
+	return &c, nil
+}
+
+// Block returns the last fully relayed block
+func (c *checkpoint) Block() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.block
+}
+
+// track marks a log as in flight, holding the checkpoint below its block until it is done.
+// It returns false if the log was already tracked.
+func (c *checkpoint) track(l types.Log) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	k := keyOf(l)
+	if _, ok := c.logs[k]; ok {
+		return false
+	}
+	c.logs[k] = &trackedLog{block: l.BlockNumber}
+
+	if l.BlockNumber > c.scanned {
+		c.scanned = l.BlockNumber
+	}
+	return true
+}
+
+// done marks a log as relayed
+func (c *checkpoint) done(l types.Log) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t, ok := c.logs[keyOf(l)]; ok {
+		t.done = true
+	}
+	return c.save()
+}
+
+// drop marks a log as removed from the canonical chain so it no longer holds the checkpoint and is never relayed
+func (c *checkpoint) drop(l types.Log) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, ok := c.logs[keyOf(l)]
+	if !ok {
+		t = &trackedLog{block: l.BlockNumber}
+		c.logs[keyOf(l)] = t
+	}
+	t.done = true
+	return c.save()
+}
+
+// advance records that every block up to and including the given block has been scanned for logs
+func (c *checkpoint) advance(block uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if block > c.scanned {
+		c.scanned = block
+	}
+	return c.save()
+}
+
+// save recomputes the checkpoint and writes it to disk if it moved, must be called with the lock held
+func (c *checkpoint) save() error {
+	block := c.scanned
+	for _, t := range c.logs {
+		if !t.done && t.block <= block {
+			block = t.block - 1
+		}
+	}
+
+	if block == c.block {
+		return nil
+	}
+	c.block = block
+
+	for k, t := range c.logs {
+		if t.done && t.block <= block {
+			delete(c.logs, k)
+		}
+	}
+
+	data, err := json.Marshal(checkpointFile{Block: block})
+	if err != nil {
+		return fmt.Errorf("cannot marshal checkpoint | %w", err)
+	}
+
+	tmp := c.path + ".tmp"
+	err = os.WriteFile(tmp, data, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("cannot write checkpoint at %s | %w", tmp, err)
+	}
+
+	return os.Rename(tmp, c.path)
+}
+
+func backfillRange(network config.NetworkConfig) uint64 {
+	if network.BackfillRange == 0 {
+		return defaultBackfillRange
+	}
+	return network.BackfillRange
+}
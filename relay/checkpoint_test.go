@@ -0,0 +1,123 @@
+package relay
+
+import (
+	"testing"
+
+	"github.com/JackalLabs/mulberry/config"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestCheckpoint(t *testing.T) {
+	type step struct {
+		op    string // track, done, drop or advance
+		block uint64
+		index uint
+		want  uint64 // checkpoint after the step
+	}
+
+	cases := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name:  "advance without logs",
+			steps: []step{{op: "advance", block: 10, want: 10}, {op: "advance", block: 8, want: 10}},
+		},
+		{
+			name: "held below a log in flight",
+			steps: []step{
+				{op: "advance", block: 3, want: 3},
+				{op: "track", block: 5, want: 3},
+				{op: "advance", block: 10, want: 4},
+				{op: "done", block: 5, want: 10},
+			},
+		},
+		{
+			name: "done out of order",
+			steps: []step{
+				{op: "advance", block: 3, want: 3},
+				{op: "track", block: 5, want: 3},
+				{op: "track", block: 7, want: 3},
+				{op: "track", block: 7, index: 1, want: 3},
+				{op: "advance", block: 10, want: 4},
+				{op: "done", block: 7, want: 4},
+				{op: "done", block: 5, want: 6},
+				{op: "done", block: 7, index: 1, want: 10},
+			},
+		},
+		{
+			name: "dropped log releases it",
+			steps: []step{
+				{op: "advance", block: 3, want: 3},
+				{op: "track", block: 5, want: 3},
+				{op: "advance", block: 8, want: 4},
+				{op: "drop", block: 5, want: 8},
+			},
+		},
+		{
+			name: "tracking past the scanned height",
+			steps: []step{
+				{op: "advance", block: 3, want: 3},
+				{op: "track", block: 12, want: 3},
+				{op: "done", block: 12, want: 12},
+			},
+		},
+	}
+
+	sender := common.HexToAddress("0x1")
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			home := t.TempDir()
+			network := config.NetworkConfig{ChainID: 1}
+			cp, err := loadCheckpoint(home, network)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, s := range c.steps {
+				l := testLog(sender, s.block, s.index)
+				switch s.op {
+				case "track":
+					if !cp.track(l) {
+						t.Fatalf("step %d: log was already tracked", i)
+					}
+				case "done":
+					err = cp.done(l)
+				case "drop":
+					err = cp.drop(l)
+				case "advance":
+					err = cp.advance(s.block)
+				}
+				if err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				if cp.Block() != s.want {
+					t.Fatalf("step %d (%s %d): checkpoint is %d, want %d", i, s.op, s.block, cp.Block(), s.want)
+				}
+			}
+
+			want := c.steps[len(c.steps)-1].want
+			reloaded, err := loadCheckpoint(home, network)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reloaded.Block() != want {
+				t.Errorf("reloaded checkpoint is %d, want %d", reloaded.Block(), want)
+			}
+		})
+	}
+}
+
+func TestCheckpointTracksOnce(t *testing.T) {
+	cp, err := loadCheckpoint(t.TempDir(), config.NetworkConfig{ChainID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := testLog(common.HexToAddress("0x1"), 5, 0)
+	if !cp.track(l) {
+		t.Fatal("first track refused")
+	}
+	if cp.track(l) {
+		t.Error("the same log was tracked twice")
+	}
+}
@@ -0,0 +1,228 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// pendingLogs holds the logs of a network that are waiting for their block to become final, keyed by block number
+type pendingLogs struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	blocks     map[uint64][]types.Log
+	count      int
+	maxPending int
+	closed     bool
+}
+
+func newPendingLogs(maxPending int) *pendingLogs {
+	if maxPending <= 0 {
+		maxPending = defaultMaxPending
+	}
+	p := pendingLogs{
+		blocks:     make(map[uint64][]types.Log),
+		maxPending: maxPending,
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return &p
+}
+
+// add holds a log until its block is final, calling wake and waiting while too many logs are pending.
+// Logs added after close are ignored, they are still held by the checkpoint.
+func (p *pendingLogs) add(l types.Log, wake func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.count >= p.maxPending && !p.closed {
+		wake()
+		p.cond.Wait()
+	}
+	if p.closed {
+		return
+	}
+	p.blocks[l.BlockNumber] = append(p.blocks[l.BlockNumber], l)
+	p.count++
+}
+
+// close releases anything waiting in add
+func (p *pendingLogs) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.cond.Broadcast()
+}
+
+// Len returns the number of pending logs
+func (p *pendingLogs) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.count
+}
+
+// remove forgets a pending log
+func (p *pendingLogs) remove(l types.Log) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	logs := p.blocks[l.BlockNumber]
+	for i := range logs {
+		if keyOf(logs[i]) == keyOf(l) {
+			p.blocks[l.BlockNumber] = append(logs[:i], logs[i+1:]...)
+			p.count--
+			p.cond.Broadcast()
+			break
+		}
+	}
+	if len(p.blocks[l.BlockNumber]) == 0 {
+		delete(p.blocks, l.BlockNumber)
+	}
+}
+
+// restore puts back logs that were taken but could not be released yet
+func (p *pendingLogs) restore(logs []types.Log) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, l := range logs {
+		p.blocks[l.BlockNumber] = append(p.blocks[l.BlockNumber], l)
+		p.count++
+	}
+}
+
+// take removes and returns the logs of a block
+func (p *pendingLogs) take(block uint64) []types.Log {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	logs := p.blocks[block]
+	delete(p.blocks, block)
+	p.count -= len(logs)
+	p.cond.Broadcast()
+	return logs
+}
+
+// blocksUpTo returns the pending block numbers at or below the given height in ascending order
+func (p *pendingLogs) blocksUpTo(height uint64) []uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var blocks []uint64
+	for b := range p.blocks {
+		if b <= height {
+			blocks = append(blocks, b)
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i] < blocks[j] })
+	return blocks
+}
+
+// notifyHead records a new chain head and wakes up the confirmation loop
+func (n *networkRelay) notifyHead(head uint64) {
+	for {
+		latest := n.latest.Load()
+		if head <= latest || n.latest.CompareAndSwap(latest, head) {
+			break
+		}
+	}
+	n.wake()
+}
+
+// wake makes the confirmation loop run again
+func (n *networkRelay) wake() {
+	select {
+	case n.heads <- struct{}{}:
+	default: // the loop is already due to run
+	}
+}
+
+// confirmLoop releases pending logs to the worker pool each time the head moves.
+// While logs are pending it also refreshes the head itself in case the log source is stalled.
+func (n *networkRelay) confirmLoop(ctx context.Context) {
+	ticker := time.NewTicker(defaultPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-n.heads:
+			n.confirm(ctx, n.latest.Load())
+		case <-ticker.C:
+			if n.pending.Len() > 0 {
+				n.refreshHead(ctx)
+			}
+		}
+	}
+}
+
+// refreshHead fetches the latest block number from the healthiest endpoint
+func (n *networkRelay) refreshHead(ctx context.Context) {
+	e, client, err := n.rpcs.get(ctx)
+	if err != nil {
+		n.logger.Printf("cannot connect to network | %s", err.Error())
+		return
+	}
+	head, err := client.BlockNumber(ctx)
+	n.rpcs.report(e, err)
+	if err != nil {
+		n.logger.Printf("cannot get current height | %s", err.Error())
+		return
+	}
+	n.notifyHead(head)
+}
+
+// confirm releases every pending log whose block is final and still canonical, block by block in ascending order.
+// Blocks that can't be checked right now stay pending until the next head.
+func (n *networkRelay) confirm(ctx context.Context, latest uint64) {
+	e, client, err := n.rpcs.get(ctx)
+	if err != nil {
+		n.logger.Printf("cannot connect to network | %s", err.Error())
+		return
+	}
+
+	final, err := finalHeight(ctx, client, n.network, latest)
+	n.rpcs.report(e, err)
+	if err != nil {
+		n.logger.Printf("cannot get final height | %s", err.Error())
+		return
+	}
+
+	for _, block := range n.pending.blocksUpTo(final) {
+		if ctx.Err() != nil {
+			return
+		}
+
+		// logs are only dropped once a quorum agrees the block changed, otherwise they stay pending
+		canonical, err := n.rpcs.canonicalHash(ctx, block, n.network.Quorum)
+		if err != nil {
+			n.logger.Printf("cannot get block hash | %s", err.Error())
+			return
+		}
+
+		logs := n.pending.take(block)
+		sort.Slice(logs, func(i, j int) bool { return logs[i].Index < logs[j].Index })
+
+		var confirmed []types.Log
+		for _, l := range logs {
+			if l.BlockHash == canonical {
+				confirmed = append(confirmed, l)
+			}
+		}
+
+		// later blocks wait on this one so logs from the same sender are never released out of order
+		err = n.rpcs.confirmBlock(ctx, canonical, confirmed, n.network.Quorum)
+		if err != nil {
+			n.logger.Printf("cannot confirm block %d | %s", block, err.Error())
+			n.pending.restore(logs)
+			return
+		}
+
+		for _, l := range logs {
+			if l.BlockHash != canonical {
+				n.dropLog(l, fmt.Sprintf("block %d is now %s", block, canonical.Hex()))
+				continue
+			}
+			n.pool.submit(l)
+		}
+	}
+}
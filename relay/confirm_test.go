@@ -0,0 +1,147 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+
+	"github.com/JackalLabs/mulberry/config"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// relayed collects the logs a test relay hands to its workers
+type relayed struct {
+	mu   sync.Mutex
+	logs []types.Log
+	wg   sync.WaitGroup
+}
+
+func (r *relayed) work(l types.Log) {
+	defer r.wg.Done()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.logs = append(r.logs, l)
+}
+
+// testRelay returns a relay for network over rpcs whose workers only collect the logs they get
+func testRelay(t *testing.T, network config.NetworkConfig, rpcs *endpointPool) (*networkRelay, *relayed) {
+	home := t.TempDir()
+	cp, err := loadCheckpoint(home, network)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &relayed{}
+	n := &networkRelay{
+		a:       &App{home: home},
+		network: network,
+		cp:      cp,
+		rpcs:    rpcs,
+		pending: newPendingLogs(100),
+		heads:   make(chan struct{}, 1),
+		logger:  zerolog.Nop(),
+	}
+	n.pool = newLogPool(1, 100, r.work)
+	t.Cleanup(func() {
+		n.pool.close()
+		_, _ = n.pool.wait(context.Background())
+	})
+	return n, r
+}
+
+// canonicalChain answers eth_getBlockByNumber with the hash of hashes for each height
+func canonicalChain(hashes map[uint64]common.Hash) func([]json.RawMessage) (any, error) {
+	return func(params []json.RawMessage) (any, error) {
+		var tag string
+		err := json.Unmarshal(params[0], &tag)
+		if err != nil {
+			return nil, err
+		}
+		number, err := hexutil.DecodeUint64(tag)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected block %s", tag)
+		}
+		hash, ok := hashes[number]
+		if !ok {
+			return nil, nil
+		}
+		return blockRef{Number: hexutil.Uint64(number), Hash: hash, Timestamp: 1}, nil
+	}
+}
+
+func TestConfirmDropsReorgedLogs(t *testing.T) {
+	sender := common.HexToAddress("0x1")
+	kept := testLog(sender, 5, 0)
+	reorged := testLog(sender, 6, 0)
+	// the same log mined again in the block that replaced the old one
+	again := reorged
+	again.BlockHash = common.HexToHash("0xbeef")
+	pendingLog := testLog(sender, 9, 0)
+
+	chain := map[uint64]common.Hash{5: kept.BlockHash, 6: again.BlockHash, 9: pendingLog.BlockHash}
+	n, r := testRelay(t, config.NetworkConfig{ChainID: 1, Finality: 2}, stubRPC(t, rpcMethods{"eth_getBlockByNumber": canonicalChain(chain)}))
+
+	err := n.cp.advance(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.wg.Add(2)
+	for _, l := range []types.Log{kept, reorged, pendingLog} {
+		n.relayLog(l)
+	}
+	// a live copy of a log the backfill already fetched is not relayed twice
+	n.relayLog(kept)
+
+	n.confirm(context.Background(), 8)
+	if n.pending.Len() != 1 {
+		t.Fatalf("%d logs still pending, want the one past finality", n.pending.Len())
+	}
+
+	// the copy in the new block comes from the subscription or the next backfill, it is relayed once final
+	n.relayLog(again)
+	n.confirm(context.Background(), 8)
+	r.wg.Wait()
+
+	if len(r.logs) != 2 || r.logs[0].BlockHash != kept.BlockHash || r.logs[1].BlockHash != again.BlockHash {
+		t.Fatalf("relayed %v, want the canonical logs of blocks 5 and 6", r.logs)
+	}
+
+	data, err := os.ReadFile(path.Join(n.a.home, "reorgs", "1.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(data), "\n") != 1 || !strings.Contains(string(data), reorged.BlockHash.Hex()) {
+		t.Errorf("recorded drops %s, want the log of the old block 6", data)
+	}
+	if n.cp.Block() != 4 {
+		t.Errorf("checkpoint is %d, want it held below the logs that are not done", n.cp.Block())
+	}
+}
+
+func TestConfirmKeepsLogsWithoutQuorum(t *testing.T) {
+	l := testLog(common.HexToAddress("0x1"), 5, 0)
+	changed := map[uint64]common.Hash{5: common.HexToHash("0xbeef")}
+	same := map[uint64]common.Hash{5: l.BlockHash}
+
+	// one endpoint saw a reorg the other one didn't, the log is neither dropped nor relayed
+	n, r := testRelay(t, config.NetworkConfig{ChainID: 1, Quorum: 2},
+		stubPool(t, rpcMethods{"eth_getBlockByNumber": canonicalChain(changed)}, rpcMethods{"eth_getBlockByNumber": canonicalChain(same)}))
+	n.relayLog(l)
+	n.confirm(context.Background(), 10)
+
+	if n.pending.Len() != 1 || len(r.logs) != 0 {
+		t.Errorf("%d logs pending and %d relayed, want the log kept pending", n.pending.Len(), len(r.logs))
+	}
+	if _, err := os.Stat(path.Join(n.a.home, "reorgs", "1.jsonl")); !os.IsNotExist(err) {
+		t.Errorf("the log was recorded as dropped: %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package relay
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/JackalLabs/mulberry/config"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+const defaultTakeoverTimeout = 20 * time.Minute
+
+// coordinator shards messages across a set of relays. Every sender has an owner picked from its address so its messages
+// keep their order, the other relays take over one after the other, each waiting another takeover timeout, if a message
+// is still pending on the contract by then.
+type coordinator struct {
+	self    common.Address
+	relays  []common.Address
+	timeout time.Duration
+}
+
+// newCoordinator returns the coordinator for the configured relay set, nil if the relay works alone
+func newCoordinator(settings config.MulberrySettings, self common.Address) (*coordinator, error) {
+	if len(settings.Relays) == 0 {
+		return nil, nil
+	}
+
+	c := coordinator{
+		self:    self,
+		timeout: time.Duration(settings.TakeoverTimeout) * time.Second,
+	}
+	if c.timeout == 0 {
+		c.timeout = defaultTakeoverTimeout
+	}
+
+	found := false
+	for _, r := range settings.Relays {
+		address := common.HexToAddress(r)
+		found = found || address == self
+		c.relays = append(c.relays, address)
+	}
+	if !found {
+		return nil, fmt.Errorf("this relay (%s) is not in the relay set", self.Hex())
+	}
+	// every relay must agree on the order, whatever order the config lists them in
+	sort.Slice(c.relays, func(i, j int) bool {
+		return strings.Compare(c.relays[i].Hex(), c.relays[j].Hex()) < 0
+	})
+	return &c, nil
+}
+
+// owner returns the index of the relay the messages of a sender belong to
+func (c *coordinator) owner(sender common.Address) int {
+	h := sha256.Sum256(sender.Bytes())
+	return int(new(big.Int).Mod(new(big.Int).SetBytes(h[:]), big.NewInt(int64(len(c.relays)))).Int64())
+}
+
+// rank returns how many relays come before this one for the messages of a sender, 0 for their owner
+func (c *coordinator) rank(sender common.Address) int {
+	owner := c.owner(sender)
+	for i, r := range c.relays {
+		if r == c.self {
+			return (i - owner + len(c.relays)) % len(c.relays)
+		}
+	}
+	return 0
+}
+
+// turnError is returned for messages another relay is in charge of until Until
+type turnError struct {
+	ID    string
+	Owner common.Address
+	Until time.Time
+}
+
+func (e *turnError) Error() string {
+	return fmt.Sprintf("message %s belongs to relay %s, taking over at %s", e.ID, e.Owner.Hex(), e.Until.Format(time.RFC3339))
+}
+
+// turn returns a turnError if another relay is in charge of a message of sender emitted in a block at this point
+func (b *bridgeReader) turn(ctx context.Context, block uint64, id string, sender common.Address) error {
+	c := b.a.coord
+	if c == nil || !b.coordinate {
+		return nil
+	}
+	rank := c.rank(sender)
+	if rank == 0 {
+		return nil
+	}
+
+	e, client, err := b.rpcs.get(ctx)
+	if err != nil {
+		return err
+	}
+	ref, err := blockAt(ctx, client, hexutil.EncodeBig(new(big.Int).SetUint64(block)))
+	b.rpcs.report(e, err)
+	if err != nil {
+		return fmt.Errorf("cannot get block %d | %w", block, err)
+	}
+
+	until := time.Unix(int64(ref.Timestamp), 0).Add(time.Duration(rank) * c.timeout)
+	if time.Now().After(until) {
+		return nil
+	}
+	return &turnError{ID: id, Owner: c.relays[c.owner(sender)], Until: until}
+}
@@ -0,0 +1,160 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/JackalLabs/mulberry/config"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+var testRelays = []string{
+	"0x00000000000000000000000000000000000000a1",
+	"0x00000000000000000000000000000000000000b2",
+	"0x00000000000000000000000000000000000000c3",
+}
+
+func TestNewCoordinator(t *testing.T) {
+	cases := []struct {
+		name   string
+		relays []string
+		self   string
+		alone  bool
+		err    bool
+	}{
+		{name: "alone", self: testRelays[0], alone: true},
+		{name: "in the set", relays: testRelays, self: testRelays[1]},
+		{name: "not in the set", relays: testRelays, self: "0x00000000000000000000000000000000000000d4", err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			coord, err := newCoordinator(config.MulberrySettings{Relays: c.relays}, common.HexToAddress(c.self))
+			if (err != nil) != c.err {
+				t.Fatalf("got error %v, want one: %t", err, c.err)
+			}
+			if (coord == nil) != (c.alone || c.err) {
+				t.Errorf("got coordinator %v", coord)
+			}
+			if coord != nil && coord.timeout != defaultTakeoverTimeout {
+				t.Errorf("takeover timeout is %s, want %s", coord.timeout, defaultTakeoverTimeout)
+			}
+		})
+	}
+}
+
+func TestCoordinatorRank(t *testing.T) {
+	// every relay must agree on the ranks whatever order its config lists the set in
+	orders := [][]string{
+		testRelays,
+		{testRelays[2], testRelays[0], testRelays[1]},
+		{testRelays[1], testRelays[2], testRelays[0]},
+	}
+
+	for s := 0; s < 20; s++ {
+		sender := common.BigToAddress(big.NewInt(int64(s*7919 + 1)))
+		want := make(map[string]int)
+
+		for o, order := range orders {
+			seen := make(map[int]bool)
+			for _, self := range testRelays {
+				coord, err := newCoordinator(config.MulberrySettings{Relays: order}, common.HexToAddress(self))
+				if err != nil {
+					t.Fatal(err)
+				}
+				rank := coord.rank(sender)
+				if seen[rank] {
+					t.Fatalf("sender %s: two relays have rank %d", sender.Hex(), rank)
+				}
+				seen[rank] = true
+
+				if o == 0 {
+					want[self] = rank
+				} else if want[self] != rank {
+					t.Errorf("sender %s: relay %s has rank %d with config order %d, %d with the first", sender.Hex(), self, rank, o, want[self])
+				}
+				if rank == 0 && coord.relays[coord.owner(sender)] != common.HexToAddress(self) {
+					t.Errorf("sender %s: rank 0 is %s but the owner is %s", sender.Hex(), self, coord.relays[coord.owner(sender)].Hex())
+				}
+			}
+			if len(seen) != len(testRelays) {
+				t.Errorf("sender %s: ranks %v are not one per relay", sender.Hex(), seen)
+			}
+		}
+	}
+}
+
+func TestTurn(t *testing.T) {
+	const timeout = 10 * time.Minute
+	now := time.Now()
+
+	cases := []struct {
+		name       string
+		rank       int
+		coordinate bool
+		mined      time.Time
+		wait       bool
+	}{
+		{name: "owner", rank: 0, coordinate: true, mined: now, wait: false},
+		{name: "next relay before its turn", rank: 1, coordinate: true, mined: now, wait: true},
+		{name: "next relay after its turn", rank: 1, coordinate: true, mined: now.Add(-timeout - time.Minute), wait: false},
+		{name: "last relay during the turn of the second", rank: 2, coordinate: true, mined: now.Add(-timeout - time.Minute), wait: true},
+		{name: "last relay after every turn", rank: 2, coordinate: true, mined: now.Add(-2*timeout - time.Minute), wait: false},
+		{name: "not coordinated", rank: 2, coordinate: false, mined: now, wait: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			coord, err := newCoordinator(config.MulberrySettings{Relays: testRelays, TakeoverTimeout: uint64(timeout / time.Second)}, common.HexToAddress(testRelays[0]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sender := senderWithRank(t, coord, c.rank)
+
+			rpcs := stubRPC(t, rpcMethods{"eth_getBlockByNumber": func(params []json.RawMessage) (any, error) {
+				var number string
+				err := json.Unmarshal(params[0], &number)
+				if err != nil || number != "0x2a" {
+					return nil, fmt.Errorf("unexpected block %s", params[0])
+				}
+				return blockRef{Number: 42, Hash: common.HexToHash("0x42"), Timestamp: hexutil.Uint64(c.mined.Unix())}, nil
+			}})
+			b := &bridgeReader{a: &App{coord: coord}, rpcs: rpcs, coordinate: c.coordinate}
+
+			err = b.turn(context.Background(), 42, "message", sender)
+			var turn *turnError
+			if errors.As(err, &turn) != c.wait {
+				t.Fatalf("got %v, want to wait: %t", err, c.wait)
+			}
+			if !c.wait {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			until := time.Unix(c.mined.Unix(), 0).Add(time.Duration(c.rank) * timeout)
+			if !turn.Until.Equal(until) || turn.Owner != coord.relays[coord.owner(sender)] {
+				t.Errorf("waiting for %s until %s, want %s until %s", turn.Owner.Hex(), turn.Until, coord.relays[coord.owner(sender)].Hex(), until)
+			}
+		})
+	}
+}
+
+// senderWithRank returns a sender address the coordinator ranks at rank
+func senderWithRank(t *testing.T, c *coordinator, rank int) common.Address {
+	for i := int64(1); i < 100; i++ {
+		sender := common.BigToAddress(big.NewInt(i * 7919))
+		if c.rank(sender) == rank {
+			return sender
+		}
+	}
+	t.Fatalf("no sender has rank %d", rank)
+	return common.Address{}
+}
@@ -0,0 +1,247 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/JackalLabs/mulberry/config"
+	"github.com/JackalLabs/mulberry/jackal/uploader"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+var deadLetterMu sync.Mutex
+
+// DeadLetter is an event that failed to relay, kept in deadletters/<id>.json under the home directory until it is retried
+type DeadLetter struct {
+	ID          string    `json:"id"`
+	ChainID     uint64    `json:"chain_id"`
+	Network     string    `json:"network"`
+	Log         types.Log `json:"log"`
+	Stage       Stage     `json:"stage,omitempty"`
+	Error       string    `json:"error"`
+	Attempts    int       `json:"attempts"`
+	FirstFailed time.Time `json:"first_failed"`
+	LastFailed  time.Time `json:"last_failed"`
+}
+
+func logID(chainID uint64, l types.Log) string {
+	return fmt.Sprintf("%d-%s-%d", chainID, l.TxHash.Hex(), l.Index)
+}
+
+func deadLetterDir(homePath string) string {
+	return path.Join(homePath, "deadletters")
+}
+
+// recordDeadLetter stores a failed event, counting another attempt if it was already stored
+func recordDeadLetter(homePath string, network config.NetworkConfig, l types.Log, failure error) (*DeadLetter, error) {
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+
+	dir := deadLetterDir(homePath)
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("cannot make the dead letter directory at %s | %w", dir, err)
+	}
+
+	id := logID(network.ChainID, l)
+	now := time.Now()
+
+	d, err := readDeadLetter(homePath, id)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		d = &DeadLetter{
+			ID:          id,
+			ChainID:     network.ChainID,
+			Network:     network.Name,
+			Log:         l,
+			FirstFailed: now,
+		}
+	}
+
+	d.Attempts++
+	d.LastFailed = now
+	d.Error = failure.Error()
+	d.Stage = ""
+	var relayErr *RelayError
+	if errors.As(failure, &relayErr) {
+		d.Stage = relayErr.Stage
+	}
+
+	return d, writeDeadLetter(homePath, d)
+}
+
+func readDeadLetter(homePath string, id string) (*DeadLetter, error) {
+	data, err := os.ReadFile(path.Join(deadLetterDir(homePath), id+".json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var d DeadLetter
+	err = json.Unmarshal(data, &d)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse dead letter %s | %w", id, err)
+	}
+	return &d, nil
+}
+
+func writeDeadLetter(homePath string, d *DeadLetter) error {
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot marshal dead letter | %w", err)
+	}
+
+	p := path.Join(deadLetterDir(homePath), d.ID+".json")
+	tmp := p + ".tmp"
+	err = os.WriteFile(tmp, data, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("cannot write dead letter at %s | %w", tmp, err)
+	}
+	return os.Rename(tmp, p)
+}
+
+// DeadLetters returns every stored dead letter, oldest first
+func (a *App) DeadLetters() ([]*DeadLetter, error) {
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+
+	entries, err := os.ReadDir(deadLetterDir(a.home))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot read the dead letter directory | %w", err)
+	}
+
+	var letters []*DeadLetter
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		d, err := readDeadLetter(a.home, strings.TrimSuffix(e.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, d)
+	}
+
+	sort.Slice(letters, func(i, j int) bool { return letters[i].FirstFailed.Before(letters[j].FirstFailed) })
+	return letters, nil
+}
+
+// DeadLetter returns a single stored dead letter
+func (a *App) DeadLetter(id string) (*DeadLetter, error) {
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+
+	d, err := readDeadLetter(a.home, id)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("dead letter %s not found", id)
+	}
+	return d, err
+}
+
+// RetryDeadLetters runs the given dead letters through the relay pipeline again.
+// Entries that go through are removed, the others are kept with another attempt counted.
+func (a *App) RetryDeadLetters(ctx context.Context, ids []string) error {
+	err := a.loadEvents()
+	if err != nil {
+		return err
+	}
+
+	var letters []*DeadLetter
+	for _, id := range ids {
+		d, err := a.DeadLetter(id)
+		if err != nil {
+			return err
+		}
+		letters = append(letters, d)
+	}
+
+	err = a.lockWAL()
+	if err != nil {
+		return err
+	}
+	defer a.unlockWAL()
+
+	err = a.updatePricing(ctx)
+	if err != nil {
+		return err
+	}
+	a.q.Listen()
+	defer func() {
+		stopCtx, cancel := context.WithTimeout(context.Background(), a.shutdownTimeout())
+		defer cancel()
+		err := a.q.Stop(stopCtx)
+		if err != nil {
+			log.Printf("cannot drain the jackal queue | %s", err.Error())
+		}
+	}()
+
+	bridges := make(map[uint64]*bridgeReader)
+	defer func() {
+		for _, b := range bridges {
+			b.rpcs.Close()
+		}
+	}()
+
+	var errs []error
+	for _, d := range letters {
+		if ctx.Err() != nil {
+			return errors.Join(append(errs, ctx.Err())...)
+		}
+
+		network, err := a.findNetwork(fmt.Sprintf("%d", d.ChainID))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s | %w", d.ID, err))
+			continue
+		}
+
+		if bridges[network.ChainID] == nil {
+			bridges[network.ChainID] = a.bridgeReader(network, newEndpointPool(append([]string{network.RPC}, network.RPCEndpoints...)...))
+		}
+
+		postCtx, cancel := context.WithTimeout(ctx, a.postTimeout())
+		err = handleLog(postCtx, a.events, a.wal, bridges[network.ChainID], &d.Log, a.w, a.q, network.ChainID, a.cfg.JackalConfig.Contract)
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s | %w", d.ID, err))
+			if !errors.Is(err, uploader.ErrStopped) {
+				_, err = recordDeadLetter(a.home, network, d.Log, err)
+				if err != nil {
+					errs = append(errs, err)
+				}
+			}
+			continue
+		}
+
+		log.Printf("Relayed dead letter %s", d.ID)
+		err = a.removeDeadLetter(d.ID)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (a *App) removeDeadLetter(id string) error {
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+
+	err := os.Remove(path.Join(deadLetterDir(a.home), id+".json"))
+	if err != nil {
+		return fmt.Errorf("cannot remove dead letter %s | %w", id, err)
+	}
+	return nil
+}
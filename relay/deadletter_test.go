@@ -0,0 +1,179 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/JackalLabs/mulberry/config"
+	"github.com/JackalLabs/mulberry/jackal/uploader"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// fixedParams serves the same storage params every time
+type fixedParams struct{}
+
+func (fixedParams) StorageParams(context.Context) (uploader.StorageParams, error) {
+	return uploader.StorageParams{PricePerTBPerMonth: 15, DenomUnit: 1_000_000, Time: time.Now()}, nil
+}
+
+// testApp returns an app in a temporary home that relays the v1 contract on a network served by rpcs
+func testApp(t *testing.T, rpcs rpcMethods) (*App, config.NetworkConfig) {
+	network := config.NetworkConfig{
+		Name:     "test",
+		ChainID:  1,
+		RPC:      stubNode(t, rpcs),
+		Contract: "0x5FbDB2315678afecb367f032d93F642f64180aa3",
+	}
+	a := &App{
+		q: uploader.NewQueue(nil, uploader.Options{
+			Oracle: uploader.StaticOracle{Price: 0.5},
+			Params: fixedParams{},
+		}),
+		cfg:  config.Config{NetworksConfig: []config.NetworkConfig{network}},
+		home: t.TempDir(),
+	}
+	return a, network
+}
+
+func TestPermanent(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "unknown event", err: relayError(StageDecode, "0x01", ErrUnknownEvent), want: true},
+		{name: "log that doesn't decode", err: relayError(StageDecode, "PostedFile", errors.New("abi: cannot unmarshal")), want: true},
+		{name: "invalid message", err: relayError(StageValidate, "PostedFile", fmt.Errorf("%w | empty merkle", ErrInvalidMsg)), want: true},
+		{name: "underpaid", err: relayError(StageValidate, "PostedFile", fmt.Errorf("paid $1 | %w", ErrUnderpaid)), want: true},
+		{name: "rejected by jackal", err: relayError(StagePost, "PostedFile", fmt.Errorf("%w: out of gas", uploader.ErrSimulation)), want: true},
+		{name: "stale price", err: relayError(StageDecode, "PostedFile", fmt.Errorf("no price yet | %w", uploader.ErrStalePrice)), want: false},
+		{name: "evm endpoint down", err: relayError(StageValidate, "PostedFile", errors.New("connection refused")), want: false},
+		{name: "jackal endpoint down", err: relayError(StagePost, "PostedFile", fmt.Errorf("%w | %w", uploader.ErrNotPosted, context.DeadlineExceeded)), want: false},
+		{name: "block header unavailable", err: errors.New("cannot get block 5"), want: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if permanent(c.err) != c.want {
+				t.Errorf("permanent(%v) is %t, want %t", c.err, !c.want, c.want)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	var b backoff
+	l := testLog(common.HexToAddress("0x1"), 5, 0)
+	other := testLog(common.HexToAddress("0x1"), 6, 0)
+
+	want := []time.Duration{retryDelay, 2 * retryDelay, 4 * retryDelay}
+	for i, w := range want {
+		if wait := b.next(l); wait != w {
+			t.Fatalf("failure %d waits %s, want %s", i+1, wait, w)
+		}
+	}
+	if wait := b.next(other); wait != retryDelay {
+		t.Errorf("another log waits %s after its first failure, want %s", wait, retryDelay)
+	}
+	for i := 0; i < 20; i++ {
+		b.next(l)
+	}
+	if wait := b.next(l); wait != maxRetryDelay {
+		t.Errorf("waits %s after many failures, want %s", wait, maxRetryDelay)
+	}
+
+	b.reset(l)
+	if wait := b.next(l); wait != retryDelay {
+		t.Errorf("waits %s after a reset, want %s", wait, retryDelay)
+	}
+}
+
+func TestRecordDeadLetter(t *testing.T) {
+	a := &App{home: t.TempDir()}
+	network := config.NetworkConfig{Name: "test", ChainID: 1}
+	first := testLog(common.HexToAddress("0x1"), 5, 0)
+	second := testLog(common.HexToAddress("0x1"), 6, 0)
+
+	_, err := recordDeadLetter(a.home, network, first, relayError(StageDecode, "PostedFile", errors.New("bad merkle")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = recordDeadLetter(a.home, network, second, errors.New("failed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := recordDeadLetter(a.home, network, first, relayError(StagePost, "PostedFile", uploader.ErrTxFailed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Attempts != 2 || d.Stage != StagePost || d.LastFailed.Before(d.FirstFailed) {
+		t.Errorf("recorded %+v, want a second attempt failing at the post stage", d)
+	}
+
+	letters, err := a.DeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 2 || letters[0].ID != logID(1, first) || letters[1].ID != logID(1, second) {
+		t.Fatalf("listed %v, want both letters oldest first", letters)
+	}
+	if letters[0].Log.TxHash != first.TxHash || letters[0].Log.BlockNumber != first.BlockNumber {
+		t.Errorf("stored log %+v, want %+v", letters[0].Log, first)
+	}
+
+	_, err = a.DeadLetter("1-0x00-0")
+	if err == nil {
+		t.Error("got a dead letter that was never recorded")
+	}
+}
+
+func TestRetryDeadLetters(t *testing.T) {
+	a, network := testApp(t, rpcMethods{})
+	contract := common.HexToAddress(network.Contract)
+
+	// one log finished before it failed again, the other has an event the contract doesn't emit
+	finished := testLog(common.HexToAddress("0x1"), 5, 0)
+	finished.Address = contract
+	unknown := testLog(common.HexToAddress("0x1"), 6, 0)
+	unknown.Address = contract
+	unknown.Topics = []common.Hash{common.HexToHash("0x01")}
+
+	journal, err := openWAL(a.home)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = journal.set(network.ChainID, finished, "message", walFinished, "ABCD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.close()
+
+	for _, l := range []types.Log{finished, unknown} {
+		_, err = recordDeadLetter(a.home, network, l, errors.New("failed"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = a.RetryDeadLetters(context.Background(), []string{logID(1, finished), logID(1, unknown)})
+	if !errors.Is(err, ErrUnknownEvent) {
+		t.Fatalf("got %v, want the unknown event to fail", err)
+	}
+
+	if _, err := os.Stat(path.Join(deadLetterDir(a.home), logID(1, finished)+".json")); !os.IsNotExist(err) {
+		t.Errorf("the letter that went through is still stored: %v", err)
+	}
+	d, err := a.DeadLetter(logID(1, unknown))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Attempts != 2 || d.Stage != StageDecode {
+		t.Errorf("kept %+v, want a second attempt failing at the decode stage", d)
+	}
+}
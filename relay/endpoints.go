@@ -0,0 +1,292 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+const (
+	maxScore     = 10
+	failPenalty  = 5
+	successBonus = 1
+)
+
+var errNoQuorum = errors.New("not enough endpoints agree")
+
+// endpoint is a single RPC or WS url with a health score, the healthiest endpoints are tried first
+type endpoint struct {
+	url    string
+	order  int
+	score  int
+	client *ethclient.Client
+}
+
+// endpointPool is the ordered list of endpoints for one network
+type endpointPool struct {
+	mu        sync.Mutex
+	endpoints []*endpoint
+}
+
+func newEndpointPool(urls ...string) *endpointPool {
+	p := endpointPool{}
+	seen := make(map[string]bool)
+	for _, u := range urls {
+		if len(u) == 0 || seen[u] {
+			continue
+		}
+		seen[u] = true
+		p.endpoints = append(p.endpoints, &endpoint{url: u, order: len(p.endpoints)})
+	}
+	return &p
+}
+
+// Len returns the number of endpoints in the pool
+func (p *endpointPool) Len() int {
+	return len(p.endpoints)
+}
+
+// ordered returns the endpoints from healthiest to least healthy, ties keep the configured order
+func (p *endpointPool) ordered() []*endpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e := make([]*endpoint, len(p.endpoints))
+	copy(e, p.endpoints)
+	sort.SliceStable(e, func(i, j int) bool {
+		if e[i].score != e[j].score {
+			return e[i].score > e[j].score
+		}
+		return e[i].order < e[j].order
+	})
+	return e
+}
+
+// connect returns a client for the endpoint, dialing it if needed
+func (p *endpointPool) connect(ctx context.Context, e *endpoint) (*ethclient.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if e.client != nil {
+		return e.client, nil
+	}
+
+	c, err := ethclient.DialContext(ctx, e.url)
+	if err != nil {
+		return nil, err
+	}
+	e.client = c
+	return c, nil
+}
+
+// get returns a client for the healthiest endpoint that can be reached
+func (p *endpointPool) get(ctx context.Context) (*endpoint, *ethclient.Client, error) {
+	var errs []error
+	for _, e := range p.ordered() {
+		c, err := p.connect(ctx, e)
+		if err != nil {
+			p.report(e, err)
+			errs = append(errs, fmt.Errorf("%s | %w", e.url, err))
+			continue
+		}
+		return e, c, nil
+	}
+	return nil, nil, fmt.Errorf("no endpoint available | %w", errors.Join(errs...))
+}
+
+// report updates the health of an endpoint after a call, dropping its connection on failure so it is redialed
+func (p *endpointPool) report(e *endpoint, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err == nil {
+		e.score += successBonus
+		if e.score > maxScore {
+			e.score = maxScore
+		}
+		return
+	}
+
+	e.score -= failPenalty
+	if e.score < -maxScore {
+		e.score = -maxScore
+	}
+	if e.client != nil {
+		e.client.Close()
+		e.client = nil
+	}
+}
+
+// Close drops every open connection
+func (p *endpointPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, e := range p.endpoints {
+		if e.client != nil {
+			e.client.Close()
+			e.client = nil
+		}
+	}
+}
+
+// filterLogs runs eth_getLogs on the healthiest endpoint, or on every endpoint if a quorum is required.
+// With a quorum the results are merged so one endpoint hiding a log can't make us skip it,
+// each log is verified against the quorum again before it is relayed.
+func (p *endpointPool) filterLogs(ctx context.Context, q ethereum.FilterQuery, quorum int) ([]types.Log, error) {
+	if quorum <= 1 {
+		e, c, err := p.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		logs, err := c.FilterLogs(ctx, q)
+		p.report(e, err)
+		return logs, err
+	}
+
+	var merged []types.Log
+	seen := make(map[logKey]bool)
+	responses := 0
+	for _, e := range p.ordered() {
+		c, err := p.connect(ctx, e)
+		if err != nil {
+			p.report(e, err)
+			continue
+		}
+		logs, err := c.FilterLogs(ctx, q)
+		p.report(e, err)
+		if err != nil {
+			continue
+		}
+		responses++
+		for _, l := range logs {
+			if !seen[keyOf(l)] {
+				seen[keyOf(l)] = true
+				merged = append(merged, l)
+			}
+		}
+	}
+
+	if responses < quorum {
+		return nil, fmt.Errorf("%w: %d of %d endpoints responded", errNoQuorum, responses, quorum)
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		if merged[i].BlockNumber != merged[j].BlockNumber {
+			return merged[i].BlockNumber < merged[j].BlockNumber
+		}
+		return merged[i].Index < merged[j].Index
+	})
+	return merged, nil
+}
+
+// canonicalHash returns the block hash at a height from the healthiest endpoint, or the hash at least quorum
+// endpoints agree on if a quorum is required, so one endpoint lagging behind a reorg can't make us drop logs
+func (p *endpointPool) canonicalHash(ctx context.Context, number uint64, quorum int) (common.Hash, error) {
+	if quorum <= 1 {
+		e, c, err := p.get(ctx)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		hash, err := blockHashAt(ctx, c, number)
+		p.report(e, err)
+		return hash, err
+	}
+
+	votes := make(map[common.Hash]int)
+	best := 0
+	for _, e := range p.ordered() {
+		c, err := p.connect(ctx, e)
+		if err != nil {
+			p.report(e, err)
+			continue
+		}
+		hash, err := blockHashAt(ctx, c, number)
+		p.report(e, err)
+		if err != nil {
+			continue
+		}
+		votes[hash]++
+		if votes[hash] >= quorum {
+			return hash, nil
+		}
+		if votes[hash] > best {
+			best = votes[hash]
+		}
+	}
+
+	return common.Hash{}, fmt.Errorf("%w: %d of %d endpoints agree on the hash of block %d", errNoQuorum, best, quorum, number)
+}
+
+// confirmBlock checks that at least quorum endpoints have every one of the given logs in the block with the given hash
+func (p *endpointPool) confirmBlock(ctx context.Context, blockHash common.Hash, logs []types.Log, quorum int) error {
+	if quorum <= 1 || len(logs) == 0 {
+		return nil
+	}
+
+	q := ethereum.FilterQuery{BlockHash: &blockHash}
+	seen := make(map[common.Address]bool)
+	for _, l := range logs {
+		if !seen[l.Address] {
+			seen[l.Address] = true
+			q.Addresses = append(q.Addresses, l.Address)
+		}
+	}
+
+	agreed := 0
+	for _, e := range p.ordered() {
+		c, err := p.connect(ctx, e)
+		if err != nil {
+			p.report(e, err)
+			continue
+		}
+		others, err := c.FilterLogs(ctx, q)
+		p.report(e, err)
+		if err != nil {
+			continue
+		}
+		if containsLogs(others, logs) {
+			agreed++
+		}
+		if agreed >= quorum {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %d of %d endpoints have the %d logs of block %s", errNoQuorum, agreed, quorum, len(logs), blockHash.Hex())
+}
+
+func containsLogs(have []types.Log, want []types.Log) bool {
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if sameLog(w, h) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func sameLog(a types.Log, b types.Log) bool {
+	if keyOf(a) != keyOf(b) || a.Address != b.Address || !bytes.Equal(a.Data, b.Data) || len(a.Topics) != len(b.Topics) {
+		return false
+	}
+	for i := range a.Topics {
+		if a.Topics[i] != b.Topics[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,291 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// errGateway makes the stub answer with a 502 instead of a JSON-RPC response, like a proxy losing the node
+var errGateway = errors.New("bad gateway")
+
+// rpcMethods answers JSON-RPC calls by method name, methods that are not in it fail
+type rpcMethods map[string]func(params []json.RawMessage) (any, error)
+
+// stubNode serves methods over HTTP and returns its url, batches included
+func stubNode(t *testing.T, methods rpcMethods) string {
+	type request struct {
+		ID     json.RawMessage   `json:"id"`
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	answer := func(req request) (map[string]any, bool) {
+		res := map[string]any{"jsonrpc": "2.0", "id": req.ID}
+		handle, ok := methods[req.Method]
+		if !ok {
+			res["error"] = map[string]any{"code": -32601, "message": "method not found"}
+		} else if result, err := handle(req.Params); errors.Is(err, errGateway) {
+			return nil, false
+		} else if err != nil {
+			res["error"] = map[string]any{"code": -32000, "message": err.Error()}
+		} else {
+			res["result"] = result
+		}
+		return res, true
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		body = bytes.TrimSpace(body)
+		batch := len(body) > 0 && body[0] == '['
+		var reqs []request
+		if batch {
+			err = json.Unmarshal(body, &reqs)
+		} else {
+			reqs = make([]request, 1)
+			err = json.Unmarshal(body, &reqs[0])
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var results []map[string]any
+		for _, req := range reqs {
+			res, ok := answer(req)
+			if !ok {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			results = append(results, res)
+		}
+		var out any = results[0]
+		if batch {
+			out = results
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+	}))
+	t.Cleanup(s.Close)
+	return s.URL
+}
+
+// stubRPC returns a pool with one stub node serving methods as its only endpoint
+func stubRPC(t *testing.T, methods rpcMethods) *endpointPool {
+	p := newEndpointPool(stubNode(t, methods))
+	t.Cleanup(p.Close)
+	return p
+}
+
+// stubPool returns a pool with a stub node per set of methods, in that order
+func stubPool(t *testing.T, nodes ...rpcMethods) *endpointPool {
+	var urls []string
+	for _, methods := range nodes {
+		urls = append(urls, stubNode(t, methods))
+	}
+	p := newEndpointPool(urls...)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// returns answers any call with result
+func returns(result any) func([]json.RawMessage) (any, error) {
+	return func([]json.RawMessage) (any, error) { return result, nil }
+}
+
+// fails answers any call with err
+func fails(err error) func([]json.RawMessage) (any, error) {
+	return func([]json.RawMessage) (any, error) { return nil, err }
+}
+
+// blockAtHeight answers eth_getBlockByNumber with the block of a height, whatever height is asked for
+func blockAtHeight(number uint64, hash common.Hash) func([]json.RawMessage) (any, error) {
+	return returns(blockRef{Number: hexutil.Uint64(number), Hash: hash, Timestamp: 1})
+}
+
+func TestEndpointFailover(t *testing.T) {
+	p := stubPool(t,
+		rpcMethods{"eth_blockNumber": fails(errGateway)},
+		rpcMethods{"eth_blockNumber": returns(hexutil.Uint64(42))},
+	)
+	ctx := context.Background()
+
+	var urls []string
+	for i := 0; i < 3; i++ {
+		e, c, err := p.get(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, e.url)
+		_, err = c.BlockNumber(ctx)
+		p.report(e, err)
+	}
+
+	// the first endpoint fails once and the healthy one is used from then on
+	if urls[0] != p.endpoints[0].url || urls[1] != p.endpoints[1].url || urls[2] != p.endpoints[1].url {
+		t.Errorf("used %v, want the first endpoint once then the second", urls)
+	}
+	if p.endpoints[0].score >= p.endpoints[1].score {
+		t.Errorf("failing endpoint scores %d, healthy one %d", p.endpoints[0].score, p.endpoints[1].score)
+	}
+}
+
+func TestFilterLogsQuorum(t *testing.T) {
+	contract := common.HexToAddress("0x5FbDB2315678afecb367f032d93F642f64180aa3")
+	sender := common.HexToAddress("0x1")
+	a, b := testLog(sender, 5, 0), testLog(sender, 6, 0)
+	a.Address, b.Address = contract, contract
+
+	cases := []struct {
+		name   string
+		nodes  []rpcMethods
+		quorum int
+		want   []types.Log
+		err    error
+	}{
+		{
+			name:   "one endpoint without quorum",
+			nodes:  []rpcMethods{{"eth_getLogs": returns([]types.Log{a})}, {"eth_getLogs": returns([]types.Log{b})}},
+			quorum: 1,
+			want:   []types.Log{a},
+		},
+		{
+			name:   "merged so no endpoint can hide a log",
+			nodes:  []rpcMethods{{"eth_getLogs": returns([]types.Log{b})}, {"eth_getLogs": returns([]types.Log{a, b})}},
+			quorum: 2,
+			want:   []types.Log{a, b},
+		},
+		{
+			name:   "not enough endpoints respond",
+			nodes:  []rpcMethods{{"eth_getLogs": returns([]types.Log{a})}, {"eth_getLogs": fails(errGateway)}},
+			quorum: 2,
+			err:    errNoQuorum,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logs, err := stubPool(t, c.nodes...).filterLogs(context.Background(), ethereum.FilterQuery{}, c.quorum)
+			if !errors.Is(err, c.err) {
+				t.Fatalf("got error %v, want %v", err, c.err)
+			}
+			if len(logs) != len(c.want) {
+				t.Fatalf("got %d logs, want %d", len(logs), len(c.want))
+			}
+			for i := range logs {
+				if !sameLog(logs[i], c.want[i]) {
+					t.Errorf("log %d is in block %d, want block %d", i, logs[i].BlockNumber, c.want[i].BlockNumber)
+				}
+			}
+		})
+	}
+}
+
+func TestConfirmBlockQuorum(t *testing.T) {
+	l := testLog(common.HexToAddress("0x1"), 5, 0)
+	other := l
+	other.Data = append([]byte{}, l.Data...)
+	other.Data[63] = 1
+
+	cases := []struct {
+		name   string
+		nodes  []rpcMethods
+		quorum int
+		err    error
+	}{
+		{name: "no quorum", nodes: []rpcMethods{{}}, quorum: 1},
+		{
+			name:   "every endpoint has the log",
+			nodes:  []rpcMethods{{"eth_getLogs": returns([]types.Log{l})}, {"eth_getLogs": returns([]types.Log{l})}},
+			quorum: 2,
+		},
+		{
+			name:   "one endpoint reports it differently",
+			nodes:  []rpcMethods{{"eth_getLogs": returns([]types.Log{l})}, {"eth_getLogs": returns([]types.Log{other})}},
+			quorum: 2,
+			err:    errNoQuorum,
+		},
+		{
+			name:   "one endpoint is down",
+			nodes:  []rpcMethods{{"eth_getLogs": returns([]types.Log{l})}, {"eth_getLogs": fails(errGateway)}, {"eth_getLogs": returns([]types.Log{l})}},
+			quorum: 2,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := stubPool(t, c.nodes...).confirmBlock(context.Background(), l.BlockHash, []types.Log{l}, c.quorum)
+			if !errors.Is(err, c.err) {
+				t.Errorf("got error %v, want %v", err, c.err)
+			}
+		})
+	}
+}
+
+func TestCanonicalHashQuorum(t *testing.T) {
+	old, reorged := common.HexToHash("0x01"), common.HexToHash("0x02")
+
+	cases := []struct {
+		name   string
+		nodes  []rpcMethods
+		quorum int
+		want   common.Hash
+		err    bool
+	}{
+		{
+			name:   "healthiest endpoint without quorum",
+			nodes:  []rpcMethods{{"eth_getBlockByNumber": blockAtHeight(5, reorged)}, {"eth_getBlockByNumber": blockAtHeight(5, old)}},
+			quorum: 1,
+			want:   reorged,
+		},
+		{
+			name: "quorum agrees",
+			nodes: []rpcMethods{
+				{"eth_getBlockByNumber": blockAtHeight(5, old)},
+				{"eth_getBlockByNumber": blockAtHeight(5, reorged)},
+				{"eth_getBlockByNumber": blockAtHeight(5, reorged)},
+			},
+			quorum: 2,
+			want:   reorged,
+		},
+		{
+			name:   "endpoints disagree",
+			nodes:  []rpcMethods{{"eth_getBlockByNumber": blockAtHeight(5, old)}, {"eth_getBlockByNumber": blockAtHeight(5, reorged)}},
+			quorum: 2,
+			err:    true,
+		},
+		{
+			name:   "block missing",
+			nodes:  []rpcMethods{{"eth_getBlockByNumber": returns(nil)}},
+			quorum: 1,
+			err:    true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			hash, err := stubPool(t, c.nodes...).canonicalHash(context.Background(), 5, c.quorum)
+			if (err != nil) != c.err {
+				t.Fatalf("got error %v, want one: %t", err, c.err)
+			}
+			if hash != c.want {
+				t.Errorf("got %s, want %s", hash.Hex(), c.want.Hex())
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/JackalLabs/mulberry/jackal/uploader"
+)
+
+// Stage is the step of the relay pipeline an event failed at
+type Stage string
+
+const (
+	StageDecode   Stage = "decode"
+	StageValidate Stage = "validate"
+	StagePost     Stage = "post"
+)
+
+var (
+	// ErrUnknownEvent is returned for logs whose signature matches no bridge event
+	ErrUnknownEvent = errors.New("unknown event signature")
+	// ErrInvalidMsg is returned for events whose Jackal message is not valid
+	ErrInvalidMsg = errors.New("invalid jackal message")
+)
+
+// RelayError is returned when an event cannot be relayed to Jackal
+type RelayError struct {
+	Stage Stage
+	Event string // event name, or the signature if it is unknown
+	Err   error
+}
+
+func (e *RelayError) Error() string {
+	return fmt.Sprintf("cannot %s %s | %s", e.Stage, e.Event, e.Err.Error())
+}
+
+func (e *RelayError) Unwrap() error {
+	return e.Err
+}
+
+func relayError(stage Stage, event string, err error) error {
+	return &RelayError{Stage: stage, Event: event, Err: err}
+}
+
+// permanent reports if an event can never be relayed as it is: it can't be decoded, its message is invalid, it is
+// underpaid or Jackal rejected it. Other failures, like an endpoint that can't be reached or a stale price,
+// may go away when the event is tried again.
+func permanent(err error) bool {
+	if errors.Is(err, uploader.ErrStalePrice) || errors.Is(err, uploader.ErrNoStorageParams) {
+		return false
+	}
+	if errors.Is(err, ErrUnknownEvent) || errors.Is(err, ErrInvalidMsg) || errors.Is(err, ErrUnderpaid) ||
+		errors.Is(err, uploader.ErrSimulation) || errors.Is(err, uploader.ErrTxFailed) {
+		return true
+	}
+	// decoding only depends on the log
+	var relayErr *RelayError
+	return errors.As(err, &relayErr) && relayErr.Stage == StageDecode
+}
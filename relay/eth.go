@@ -1,111 +1,392 @@
 package relay
 
 import (
-	"os"
-	"os/signal"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
 	"github.com/JackalLabs/mulberry/config"
+	"github.com/JackalLabs/mulberry/jackal/uploader"
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/ethclient"
 )
 
-func (a *App) ListenToEthereumNetwork(network config.NetworkConfig, wg *sync.WaitGroup) {
+const (
+	defaultPollInterval = 12 * time.Second
+	// a log that failed for a reason that may go away is tried again after retryDelay, doubled on every failure
+	retryDelay    = 10 * time.Second
+	maxRetryDelay = 10 * time.Minute
+)
+
+// networkRelay holds the state of the relay for a single EVM network
+type networkRelay struct {
+	a       *App
+	network config.NetworkConfig
+	query   ethereum.FilterQuery
+	cp      *checkpoint
+	rpcs    *endpointPool
+	wss     *endpointPool
+	bridge  *bridgeReader
+	pending *pendingLogs
+	pool    *logPool
+	latest  atomic.Uint64
+	heads   chan struct{}
+	retries backoff
+	logger  zerolog.Logger
+}
+
+// ListenToEthereumNetwork relays logs from a network until ctx is done, then gives the logs in flight until stopCtx is done to finish
+func (a *App) ListenToEthereumNetwork(ctx context.Context, stopCtx context.Context, network config.NetworkConfig) error {
 	subLogger := log.With().Str("network", network.Name).Logger()
 
 	subLogger.Printf("Connecting to %s", network.Name)
 
-	jackalContract := a.cfg.JackalConfig.Contract
+	cp, err := loadCheckpoint(a.home, network)
+	if err != nil {
+		return fmt.Errorf("%s: cannot load checkpoint | %w", network.Name, err)
+	}
 
-	// Specify the contract address
-	contractAddress := common.HexToAddress(network.Contract)
-	query := ethereum.FilterQuery{
-		Addresses: []common.Address{contractAddress},
+	n := &networkRelay{
+		a:       a,
+		network: network,
+		// Specify the contract addresses
+		query: ethereum.FilterQuery{
+			Addresses: contractAddresses(network),
+		},
+		cp:      cp,
+		rpcs:    newEndpointPool(append([]string{network.RPC}, network.RPCEndpoints...)...),
+		wss:     newEndpointPool(append([]string{network.WS}, network.WSEndpoints...)...),
+		pending: newPendingLogs(network.MaxPending),
+		heads:   make(chan struct{}, 1),
+		logger:  subLogger,
 	}
+	defer n.rpcs.Close()
+	defer n.wss.Close()
+	n.bridge = a.bridgeReader(network, n.rpcs).coordinated()
+	n.bridge.batcher = newFinishBatcher(n.bridge)
+	n.pool = newLogPool(network.Workers, network.MaxPending, n.processLog)
+	go n.confirmLoop(ctx)
 
-	// Subscribe to the logs
-	var sub ethereum.Subscription
-	var logs chan types.Log
+	n.resumeUnfinished()
 
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		// nothing new gets queued from here on, whatever is left is held by the checkpoint for the next start
+		n.pending.close()
+		n.pool.close()
+	}()
 
-	stopped := false
-	for !stopped {
-		_, err := ethclient.Dial(network.RPC)
-		if err != nil {
-			subLogger.Printf("Failed to connect to the Ethereum RPC client, retrying in 5 seconds: %v", err)
-			subLogger.Printf("rpc client: %s", network.RPC)
-			time.Sleep(5 * time.Second)
-			continue
+	for ctx.Err() == nil {
+		switch network.LogSource {
+		case config.LogSourceHTTP:
+			n.pollLogs(ctx)
+		default:
+			n.subscribeLogs(ctx)
 		}
 
-		wsClient, err := ethclient.Dial(network.WS)
-		if err != nil {
-			subLogger.Printf("Failed to connect to the Ethereum WS client, retrying in 5 seconds: %v", err)
-			subLogger.Printf("ws client: %s", network.WS)
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+		}
+	}
+
+	n.logger.Print("Exiting...")
+	inFlight, err := n.pool.wait(stopCtx)
+	if n.bridge.batcher != nil {
+		// the batches go out over n.rpcs, a message whose batch is not mined in time is finished on the next start
+		errBatch := n.bridge.batcher.close(stopCtx)
+		if errBatch != nil {
+			n.logger.Printf("Batches of finishMessage calls were still being sent at shutdown: %v", errBatch)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %d logs were still being relayed at shutdown | %w", network.Name, inFlight, err)
+	}
+	return nil
+}
+
+// contractAddresses returns the address of every contract watched on a network
+func contractAddresses(network config.NetworkConfig) []common.Address {
+	var addresses []common.Address
+	for _, c := range network.AllContracts() {
+		addresses = append(addresses, common.HexToAddress(c.Address))
+	}
+	return addresses
+}
+
+// subscribeLogs listens to logs over the healthiest WS endpoint until the subscription fails or ctx is done
+func (n *networkRelay) subscribeLogs(ctx context.Context) {
+	e, wsClient, err := n.wss.get(ctx)
+	if err != nil {
+		n.logger.Printf("Failed to connect to the Ethereum WS client, retrying in 5 seconds: %v", err)
+		return
+	}
 
-			if wsClient != nil {
-				wsClient.Close()
+	logs := make(chan types.Log)
+	sub, err := wsClient.SubscribeFilterLogs(ctx, n.query, logs)
+	n.wss.report(e, err)
+	if err != nil {
+		n.logger.Printf("Failed to subscribe, retrying in 5 seconds: %v", err)
+		n.logger.Printf("ws client: %s", e.url)
+		return
+	}
+	defer sub.Unsubscribe()
+
+	heads := make(chan *types.Header)
+	headSub, err := wsClient.SubscribeNewHead(ctx, heads)
+	n.wss.report(e, err)
+	if err != nil {
+		n.logger.Printf("Failed to subscribe to new heads, retrying in 5 seconds: %v", err)
+		return
+	}
+	defer headSub.Unsubscribe()
+
+	// Catch up on anything emitted while we were disconnected. Live logs it already fetched are not tracked twice,
+	// a log mined again in another block after a reorg has another block hash and is relayed
+	backfilled, err := n.backfill(ctx, n.cp.Block(), false)
+	if err != nil {
+		n.logger.Printf("Failed to backfill, retrying in 5 seconds: %v", err)
+		return
+	}
+	n.notifyHead(backfilled)
+	n.logger.Printf("Ready to listen on %s with %s", n.network.Name, e.url)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-sub.Err():
+			n.logger.Printf("Subscription error, reconnecting: %v", err)
+			n.wss.report(e, errors.Join(errors.New("subscription dropped"), err))
+			return
+		case err := <-headSub.Err():
+			n.logger.Printf("Head subscription error, reconnecting: %v", err)
+			n.wss.report(e, errors.Join(errors.New("head subscription dropped"), err))
+			return
+		case head := <-heads:
+			n.notifyHead(head.Number.Uint64())
+		case ilog := <-logs:
+			if ilog.Removed {
+				n.dropLog(ilog, "removed by the node")
+				continue
 			}
-			time.Sleep(5 * time.Second)
-			continue
+			n.logger.Printf("Log received: %s", ilog.Address.Hex())
+			n.relayLog(ilog)
 		}
+	}
+}
 
-		sub, logs, err = subscribeLogs(wsClient, query)
-		if err != nil {
-			subLogger.Printf("Failed to subscribe, retrying in 5 seconds: %v", err)
-			subLogger.Printf("ws client: %s", network.WS)
-			if wsClient != nil {
-				wsClient.Close()
+// pollLogs fetches final logs over the RPC endpoints every poll interval until a request fails or ctx is done
+func (n *networkRelay) pollLogs(ctx context.Context) {
+	interval := defaultPollInterval
+	if n.network.PollInterval > 0 {
+		interval = time.Duration(n.network.PollInterval) * time.Second
+	}
+
+	polled, err := n.backfill(ctx, n.cp.Block(), true)
+	if err != nil {
+		n.logger.Printf("Failed to backfill, retrying in 5 seconds: %v", err)
+		return
+	}
+	n.notifyHead(polled)
+	n.logger.Printf("Ready to poll %s every %s", n.network.Name, interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			polled, err = n.backfill(ctx, polled, true)
+			if err != nil {
+				n.logger.Printf("Failed to poll logs, retrying in 5 seconds: %v", err)
+				return
 			}
-			time.Sleep(5 * time.Second)
+			n.notifyHead(polled)
+		}
+	}
+}
+
+// backfill fetches every log after the given block up to the current head in bounded ranges, returning the height it caught up to.
+// With final set it stops at the final height instead, a log reorged into a block it already fetched is never seen otherwise.
+func (n *networkRelay) backfill(ctx context.Context, after uint64, final bool) (uint64, error) {
+	e, client, err := n.rpcs.get(ctx)
+	if err != nil {
+		return after, err
+	}
+	latest, err := client.BlockNumber(ctx)
+	n.rpcs.report(e, err)
+	if err != nil {
+		return after, err
+	}
+	n.notifyHead(latest)
+
+	head := latest
+	if final {
+		head, err = finalHeight(ctx, client, n.network, latest)
+		n.rpcs.report(e, err)
+		if err != nil {
+			return after, err
+		}
+	}
+
+	if after == 0 { // nothing relayed yet on this network, start from the current head
+		return head, n.cp.advance(head)
+	}
+	if head <= after {
+		return after, nil
+	}
+
+	step := backfillRange(n.network)
+	for from := after + 1; from <= head; from += step {
+		if ctx.Err() != nil {
+			return from - 1, ctx.Err()
+		}
+
+		to := from + step - 1
+		if to > head {
+			to = head
+		}
+
+		q := n.query
+		q.FromBlock = new(big.Int).SetUint64(from)
+		q.ToBlock = new(big.Int).SetUint64(to)
+
+		logs, err := n.rpcs.filterLogs(ctx, q, n.network.Quorum)
+		if err != nil {
+			return from - 1, err
+		}
+
+		n.logger.Printf("Fetched blocks %d-%d with %d logs", from, to, len(logs))
+		for _, l := range logs {
+			n.relayLog(l)
+		}
+	}
+
+	return head, n.cp.advance(head)
+}
+
+// resumeUnfinished relays the logs whose message was started but not finished before the last shutdown again,
+// the write-ahead log makes them pick up where they stopped
+func (n *networkRelay) resumeUnfinished() {
+	for _, l := range n.a.wal.unfinished(n.network.ChainID) {
+		// logs past the checkpoint are tracked so the backfill doesn't relay them a second time,
+		// the ones before it are not fetched again and must not hold the checkpoint back
+		if l.BlockNumber > n.cp.Block() && !n.cp.track(l) {
 			continue
 		}
-		subLogger.Printf("Ready to listen on %s", network.Name)
-
-		// Listening loop
-		func() {
-			defer func() {
-				// Unsubscribe and close client on exit
-				if sub != nil {
-					sub.Unsubscribe()
-				}
-				wsClient.Close()
-			}()
-
-			for {
-				select {
-				case <-sigs:
-					log.Print("Exiting...")
-					stopped = true
-					return
-				case err := <-sub.Err():
-					subLogger.Printf("Subscription error, reconnecting: %v", err)
-					return // Break out of the loop to retry
-				case ilog := <-logs:
-					subLogger.Printf("Log received: %s", ilog.Address.Hex())
-
-					ll := ilog
-					go func(loggy types.Log) {
-						err := waitForReceipt(wsClient, loggy.TxHash, network, func(_ *types.Receipt) {
-							subLogger.Printf("Inner log index: %d", loggy.Index)
-							handleLog(&loggy, a.w, a.wEth, a.q, network.ChainID, network.RPC, jackalContract, a.cfg.MulberrySettings.CastPath)
-						})
-						if err != nil {
-							subLogger.Printf("Error getting receipt for tx %s: %v", loggy.TxHash.Hex(), err)
-						}
-					}(ll)
-				}
-			}
-		}()
+		n.logger.Printf("Resuming log %d of tx %s", l.Index, l.TxHash.Hex())
+		n.pool.submit(l)
+	}
+}
+
+// relayLog holds the log until its block is final, blocking while too many logs are pending
+func (n *networkRelay) relayLog(l types.Log) {
+	if !n.cp.track(l) {
+		return
+	}
+	n.pending.add(l, n.wake)
+}
+
+// processLog relays a final log to Jackal, moving the checkpoint once it is done or stored as a dead letter.
+// Logs that failed for a reason that may go away are tried again instead.
+func (n *networkRelay) processLog(l types.Log) {
+	a := n.a
+	network := n.network
+	jackalContract := a.cfg.JackalConfig.Contract
+
+	n.logger.Printf("Inner log index: %d", l.Index)
+	// not tied to the relay context, the queue drains on shutdown and fails what is left with ErrStopped
+	ctx, cancel := context.WithTimeout(context.Background(), a.postTimeout())
+	defer cancel()
+
+	err := handleLog(ctx, a.events, a.wal, n.bridge, &l, a.w, a.q, network.ChainID, jackalContract)
+	if errors.Is(err, uploader.ErrStopped) {
+		n.logger.Printf("Log %d of tx %s was not relayed, it will be picked up again on the next start: %v", l.Index, l.TxHash.Hex(), err)
+		return
+	}
+	var turn *turnError
+	if errors.As(err, &turn) {
+		// the checkpoint holds the log until then, it is picked up again on the next start if the relay stops first
+		n.logger.Printf("Log %d of tx %s waits: %v", l.Index, l.TxHash.Hex(), err)
+		time.AfterFunc(time.Until(turn.Until), func() { n.pool.submit(l) })
+		return
+	}
+	if err != nil && !permanent(err) {
+		// the checkpoint holds the log while it waits, it is picked up again on the next start if the relay stops first
+		wait := n.retries.next(l)
+		n.logger.Printf("Log %d of tx %s failed, trying again in %s: %v", l.Index, l.TxHash.Hex(), wait, err)
+		time.AfterFunc(wait, func() { n.pool.submit(l) })
+		return
+	}
+	n.retries.reset(l)
+	if err != nil {
+		d, errRecord := recordDeadLetter(a.home, network, l, err)
+		if errRecord != nil {
+			// keep it in the checkpoint so it is tried again on the next start instead of being lost
+			n.logger.Printf("Log %d of tx %s failed (%v) and could not be stored as a dead letter: %v", l.Index, l.TxHash.Hex(), err, errRecord)
+			return
+		}
+		n.logger.Printf("Log %d of tx %s failed, stored as dead letter %s: %v", l.Index, l.TxHash.Hex(), d.ID, err)
+	}
+
+	err = n.cp.done(l)
+	if err != nil {
+		n.logger.Printf("Failed to save checkpoint: %v", err)
 	}
+}
+
+// backoff counts the failed attempts of each log to space out the next ones
+type backoff struct {
+	mu       sync.Mutex
+	attempts map[logKey]int
+}
 
-	wg.Done()
+// next counts another failure of a log and returns how long it waits before it is tried again
+func (b *backoff) next(l types.Log) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.attempts == nil {
+		b.attempts = make(map[logKey]int)
+	}
+
+	wait := retryDelay << b.attempts[keyOf(l)]
+	if wait >= maxRetryDelay {
+		return maxRetryDelay
+	}
+	b.attempts[keyOf(l)]++
+	return wait
+}
+
+// reset forgets the failures of a log that is done
+func (b *backoff) reset(l types.Log) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.attempts, keyOf(l))
+}
+
+// dropLog records a log that left the canonical chain and releases it from the checkpoint
+func (n *networkRelay) dropLog(l types.Log, reason string) {
+	n.logger.Printf("Dropping log %d of tx %s in block %d (%s): %s", l.Index, l.TxHash.Hex(), l.BlockNumber, l.BlockHash.Hex(), reason)
+
+	err := recordDrop(n.a.home, n.network, l, reason)
+	if err != nil {
+		n.logger.Printf("Failed to record dropped log: %v", err)
+	}
+
+	n.pending.remove(l)
+	err = n.cp.drop(l)
+	if err != nil {
+		n.logger.Printf("Failed to save checkpoint: %v", err)
+	}
 }
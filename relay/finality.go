@@ -0,0 +1,28 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/JackalLabs/mulberry/config"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// finalHeight returns the highest block on a network that is considered final under its finality mode given the latest head
+func finalHeight(ctx context.Context, client *ethclient.Client, network config.NetworkConfig, latest uint64) (uint64, error) {
+	switch network.FinalityMode {
+	case config.FinalitySafe, config.FinalityFinalized:
+		head, err := blockAt(ctx, client, network.FinalityMode)
+		if err != nil {
+			return 0, fmt.Errorf("cannot get %s block | %w", network.FinalityMode, err)
+		}
+		return uint64(head.Number), nil
+	case "", config.FinalityConfirmations:
+		if latest < network.Finality {
+			return 0, nil
+		}
+		return latest - network.Finality, nil
+	default:
+		return 0, fmt.Errorf("unknown finality mode %q", network.FinalityMode)
+	}
+}
@@ -0,0 +1,95 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/JackalLabs/mulberry/config"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// taggedBlocks answers eth_getBlockByNumber for the safe and finalized tags with the heights in tags,
+// and for numbers with the hashes of chain
+func taggedBlocks(tags map[string]uint64, chain map[uint64]common.Hash) func([]json.RawMessage) (any, error) {
+	canonical := canonicalChain(chain)
+	return func(params []json.RawMessage) (any, error) {
+		var tag string
+		err := json.Unmarshal(params[0], &tag)
+		if err != nil {
+			return nil, err
+		}
+		if number, ok := tags[tag]; ok {
+			return blockRef{Number: hexutil.Uint64(number), Hash: chain[number], Timestamp: 1}, nil
+		}
+		if tag == config.FinalitySafe || tag == config.FinalityFinalized {
+			return nil, fmt.Errorf("%s block not supported", tag)
+		}
+		return canonical(params)
+	}
+}
+
+func TestFinalHeight(t *testing.T) {
+	tags := map[string]uint64{config.FinalitySafe: 90, config.FinalityFinalized: 70}
+
+	cases := []struct {
+		name    string
+		network config.NetworkConfig
+		tags    map[string]uint64
+		want    uint64
+		err     bool
+	}{
+		{name: "confirmations", network: config.NetworkConfig{Finality: 12}, want: 88},
+		{name: "fewer blocks than confirmations", network: config.NetworkConfig{Finality: 200}, want: 0},
+		{name: "safe", network: config.NetworkConfig{Finality: 12, FinalityMode: config.FinalitySafe}, tags: tags, want: 90},
+		{name: "finalized", network: config.NetworkConfig{FinalityMode: config.FinalityFinalized}, tags: tags, want: 70},
+		{name: "tag not supported", network: config.NetworkConfig{FinalityMode: config.FinalitySafe}, err: true},
+		{name: "unknown mode", network: config.NetworkConfig{FinalityMode: "latest"}, err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, err := ethclient.Dial(stubNode(t, rpcMethods{"eth_getBlockByNumber": taggedBlocks(c.tags, nil)}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			final, err := finalHeight(context.Background(), client, c.network, 100)
+			if (err != nil) != c.err {
+				t.Fatalf("got error %v, want one: %t", err, c.err)
+			}
+			if final != c.want {
+				t.Errorf("final height is %d, want %d", final, c.want)
+			}
+		})
+	}
+}
+
+func TestConfirmFinalizedLogs(t *testing.T) {
+	sender := common.HexToAddress("0x1")
+	final, unsafe := testLog(sender, 5, 0), testLog(sender, 8, 0)
+	chain := map[uint64]common.Hash{5: final.BlockHash, 6: common.HexToHash("0x06"), 8: unsafe.BlockHash}
+
+	// deep enough for 2 confirmations, but only block 6 is finalized
+	n, r := testRelay(t, config.NetworkConfig{ChainID: 1, Finality: 2, FinalityMode: config.FinalityFinalized},
+		stubRPC(t, rpcMethods{"eth_getBlockByNumber": taggedBlocks(map[string]uint64{config.FinalityFinalized: 6}, chain)}))
+
+	r.wg.Add(1)
+	for _, l := range []types.Log{final, unsafe} {
+		n.relayLog(l)
+	}
+	n.confirm(context.Background(), 20)
+	r.wg.Wait()
+
+	if len(r.logs) != 1 || r.logs[0].BlockNumber != 5 {
+		t.Fatalf("relayed %v, want the log of block 5", r.logs)
+	}
+	if n.pending.Len() != 1 {
+		t.Errorf("%d logs pending, want the one past the finalized block", n.pending.Len())
+	}
+}
@@ -0,0 +1,206 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/rs/zerolog/log"
+)
+
+const defaultFinishBatchInterval = 30 * time.Second
+
+// multicallABI holds aggregate3 of Multicall3
+const multicallABI = `[{"inputs":[{"components":[{"internalType":"address","name":"target","type":"address"},{"internalType":"bool","name":"allowFailure","type":"bool"},{"internalType":"bytes","name":"callData","type":"bytes"}],"internalType":"struct Multicall3.Call3[]","name":"calls","type":"tuple[]"}],"name":"aggregate3","outputs":[{"components":[{"internalType":"bool","name":"success","type":"bool"},{"internalType":"bytes","name":"returnData","type":"bytes"}],"internalType":"struct Multicall3.Result[]","name":"returnData","type":"tuple[]"}],"stateMutability":"payable","type":"function"}]`
+
+var multicallCalls abi.ABI
+
+func init() {
+	var err error
+	multicallCalls, err = abi.JSON(strings.NewReader(multicallABI))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// call3 is a Multicall3.Call3, field names match the ABI components
+type call3 struct {
+	Target       common.Address
+	AllowFailure bool
+	CallData     []byte
+}
+
+// finishCall is a finishMessage waiting for its batch, done gets the outcome of the transaction it went out in
+type finishCall struct {
+	contract common.Address
+	id       string
+	done     func(*types.Receipt, error)
+}
+
+// finishBatcher collects the finishMessage calls of a network and sends them together through its multicall contract,
+// once the batch is full or its oldest call waited the interval. It lives as long as the network listener.
+type finishBatcher struct {
+	bridge    *bridgeReader
+	multicall common.Address
+	size      int
+	interval  time.Duration
+
+	mu      sync.Mutex
+	calls   []finishCall
+	timer   *time.Timer
+	closed  bool
+	sending sync.WaitGroup
+}
+
+// newFinishBatcher returns the batcher of the network a bridge reader reads, or nil if batching is off
+func newFinishBatcher(bridge *bridgeReader) *finishBatcher {
+	network := bridge.network
+	if network.FinishBatchSize <= 1 {
+		return nil
+	}
+	interval := time.Duration(network.FinishBatchInterval) * time.Second
+	if interval == 0 {
+		interval = defaultFinishBatchInterval
+	}
+	return &finishBatcher{
+		bridge:    bridge,
+		multicall: common.HexToAddress(network.Multicall),
+		size:      network.FinishBatchSize,
+		interval:  interval,
+	}
+}
+
+// add queues a finishMessage call without waiting for its batch. Once the batcher is closed the call is sent on its own.
+func (f *finishBatcher) add(contract common.Address, id string, done func(*types.Receipt, error)) {
+	c := finishCall{contract: contract, id: id, done: done}
+
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		f.flush([]finishCall{c})
+		return
+	}
+	defer f.mu.Unlock()
+
+	f.calls = append(f.calls, c)
+	if len(f.calls) >= f.size {
+		f.send(f.take())
+	} else if len(f.calls) == 1 {
+		f.timer = time.AfterFunc(f.interval, f.flushWaiting)
+	}
+}
+
+// take empties the batch, f.mu must be held
+func (f *finishBatcher) take() []finishCall {
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+	calls := f.calls
+	f.calls = nil
+	return calls
+}
+
+// send flushes a batch in the background, f.mu must be held
+func (f *finishBatcher) send(calls []finishCall) {
+	f.sending.Add(1)
+	go func() {
+		defer f.sending.Done()
+		f.flush(calls)
+	}()
+}
+
+func (f *finishBatcher) flushWaiting() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.calls) > 0 {
+		f.send(f.take())
+	}
+}
+
+// close sends the batch that is still filling and waits for the batches in flight until ctx is done
+func (f *finishBatcher) close(ctx context.Context) error {
+	f.mu.Lock()
+	f.closed = true
+	if len(f.calls) > 0 {
+		f.send(f.take())
+	}
+	f.mu.Unlock()
+
+	sent := make(chan struct{})
+	go func() {
+		f.sending.Wait()
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flush sends a batch in one aggregate3 transaction. If the batch reverts, one bad call takes the others with it,
+// so every call is sent again on its own.
+func (f *finishBatcher) flush(calls []finishCall) {
+	ctx, cancel := context.WithTimeout(context.Background(), finishTimeout)
+	defer cancel()
+
+	if len(calls) == 1 {
+		f.finishOne(ctx, calls[0])
+		return
+	}
+
+	receipt, err := f.sendBatch(ctx, calls)
+	if err == nil {
+		log.Printf("Finished %d messages in %s", len(calls), receipt.TxHash.Hex())
+		for _, c := range calls {
+			c.done(receipt, nil)
+		}
+		return
+	}
+	if !errors.Is(err, ErrTxReverted) && !isRevert(err) {
+		for _, c := range calls {
+			c.done(nil, err)
+		}
+		return
+	}
+
+	log.Printf("Batch of %d finishMessage calls reverted, sending them one by one: %v", len(calls), err)
+	var wg sync.WaitGroup
+	for _, c := range calls {
+		wg.Add(1)
+		go func(c finishCall) {
+			defer wg.Done()
+			f.finishOne(ctx, c)
+		}(c)
+	}
+	wg.Wait()
+}
+
+func (f *finishBatcher) finishOne(ctx context.Context, c finishCall) {
+	receipt, err := f.bridge.finishMessage(ctx, c.contract, c.id)
+	c.done(receipt, err)
+}
+
+func (f *finishBatcher) sendBatch(ctx context.Context, calls []finishCall) (*types.Receipt, error) {
+	batch := make([]call3, len(calls))
+	for i, c := range calls {
+		data, err := f.bridge.pack(c.contract, "finishMessage", c.id)
+		if err != nil {
+			return nil, &SendError{Method: "aggregate3", Err: err}
+		}
+		batch[i] = call3{Target: c.contract, CallData: data}
+	}
+	data, err := packCall(multicallCalls.Methods["aggregate3"], batch)
+	if err != nil {
+		return nil, &SendError{Method: "aggregate3", Err: err}
+	}
+	return f.bridge.a.sender.manager(f.bridge.network).send(ctx, f.bridge.rpcs, "aggregate3", f.multicall, data)
+}
@@ -0,0 +1,256 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+var testMulticall = common.HexToAddress("0x00000000000000000000000000000000000000ca")
+
+// stubChain mines every transaction it is sent in block 10, reverting the batches when revertBatches is set
+type stubChain struct {
+	mu            sync.Mutex
+	sent          []*types.Transaction
+	revertBatches bool
+}
+
+func (s *stubChain) methods() rpcMethods {
+	return rpcMethods{
+		"eth_estimateGas":           returns(hexutil.Uint64(50_000)),
+		"eth_getBlockByNumber":      latestHeader(gwei(5)),
+		"eth_maxPriorityFeePerGas":  returns((*hexutil.Big)(gwei(1))),
+		"eth_getTransactionCount":   returns(hexutil.Uint64(0)),
+		"eth_sendRawTransaction":    s.send,
+		"eth_getTransactionReceipt": s.receipt,
+	}
+}
+
+func (s *stubChain) send(params []json.RawMessage) (any, error) {
+	var raw hexutil.Bytes
+	err := json.Unmarshal(params[0], &raw)
+	if err != nil {
+		return nil, err
+	}
+	tx := new(types.Transaction)
+	err = tx.UnmarshalBinary(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, tx)
+	return tx.Hash(), nil
+}
+
+func (s *stubChain) receipt(params []json.RawMessage) (any, error) {
+	var hash common.Hash
+	err := json.Unmarshal(params[0], &hash)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, tx := range s.sent {
+		if tx.Hash() != hash {
+			continue
+		}
+		status := types.ReceiptStatusSuccessful
+		if s.revertBatches && *tx.To() == testMulticall {
+			status = types.ReceiptStatusFailed
+		}
+		return &types.Receipt{Status: status, TxHash: hash, BlockNumber: big.NewInt(10), Logs: []*types.Log{}}, nil
+	}
+	return nil, nil
+}
+
+// calls describes the transactions sent so far, like "aggregate3 of 2" or "finishMessage a", sorted
+func (s *stubChain) calls(t *testing.T) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	finish := abiVersions["v1"].Methods["finishMessage"]
+	aggregate := multicallCalls.Methods["aggregate3"]
+	var calls []string
+	for _, tx := range s.sent {
+		switch {
+		case *tx.To() == testMulticall:
+			args, err := aggregate.Inputs.Unpack(tx.Data()[4:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			batch := *abi.ConvertType(args[0], new([]call3)).(*[]call3)
+			calls = append(calls, fmt.Sprintf("aggregate3 of %d", len(batch)))
+		default:
+			args, err := finish.Inputs.Unpack(tx.Data()[4:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			calls = append(calls, fmt.Sprintf("finishMessage %s", args[0]))
+		}
+	}
+	sort.Strings(calls)
+	return calls
+}
+
+// testBatcher returns a batcher of size calls sending its batches to chain
+func testBatcher(t *testing.T, size int, interval time.Duration, chain *stubChain) (*finishBatcher, *App, common.Address) {
+	a, network := testApp(t, rpcMethods{})
+	network.FinishBatchSize = size
+	network.Multicall = testMulticall.Hex()
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.sender = newEVMSender(key)
+
+	b := testBridge(t, a, network, chain.methods())
+	b.batcher = newFinishBatcher(b)
+	b.batcher.interval = interval
+	return b.batcher, a, common.HexToAddress(network.Contract)
+}
+
+func TestFinishBatcher(t *testing.T) {
+	cases := []struct {
+		name     string
+		size     int
+		interval time.Duration
+		ids      []string
+		reverts  bool
+		close    bool // close the batcher instead of waiting for its batches
+		calls    []string
+	}{
+		{name: "full batch", size: 2, interval: time.Hour, ids: []string{"a", "b"}, calls: []string{"aggregate3 of 2"}},
+		{name: "interval", size: 10, interval: 10 * time.Millisecond, ids: []string{"a", "b"}, calls: []string{"aggregate3 of 2"}},
+		{name: "one call on its own", size: 10, interval: 10 * time.Millisecond, ids: []string{"a"}, calls: []string{"finishMessage a"}},
+		{
+			name:     "batch reverts",
+			size:     2,
+			interval: time.Hour,
+			ids:      []string{"a", "b"},
+			reverts:  true,
+			calls:    []string{"aggregate3 of 2", "finishMessage a", "finishMessage b"},
+		},
+		{name: "closed", size: 10, interval: time.Hour, ids: []string{"a", "b"}, close: true, calls: []string{"aggregate3 of 2"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			chain := &stubChain{revertBatches: c.reverts}
+			f, _, contract := testBatcher(t, c.size, c.interval, chain)
+
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			finished := make(map[string]*types.Receipt)
+			for _, id := range c.ids {
+				wg.Add(1)
+				f.add(contract, id, func(receipt *types.Receipt, err error) {
+					defer wg.Done()
+					if err != nil {
+						t.Errorf("finishing %s failed: %v", id, err)
+					}
+					mu.Lock()
+					finished[id] = receipt
+					mu.Unlock()
+				})
+			}
+
+			if c.close {
+				err := f.close(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			wg.Wait()
+
+			calls := chain.calls(t)
+			if fmt.Sprint(calls) != fmt.Sprint(c.calls) {
+				t.Errorf("sent %v, want %v", calls, c.calls)
+			}
+			for _, id := range c.ids {
+				if finished[id] == nil || finished[id].Status != types.ReceiptStatusSuccessful {
+					t.Errorf("%s finished with %+v, want a successful receipt", id, finished[id])
+				}
+			}
+		})
+	}
+}
+
+func TestFinishBatcherAfterClose(t *testing.T) {
+	chain := &stubChain{}
+	f, _, contract := testBatcher(t, 10, time.Hour, chain)
+	err := f.close(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a worker still finishing a log at shutdown sends its call on its own
+	var done error = errors.New("not called")
+	f.add(contract, "a", func(_ *types.Receipt, err error) { done = err })
+	if done != nil {
+		t.Fatalf("got %v, want the call sent before add returns", done)
+	}
+	if calls := chain.calls(t); fmt.Sprint(calls) != "[finishMessage a]" {
+		t.Errorf("sent %v, want a single finishMessage", calls)
+	}
+}
+
+func TestHandleLogQueuesFinish(t *testing.T) {
+	chain := &stubChain{}
+	f, a, contract := testBatcher(t, 10, time.Hour, chain)
+	err := a.updatePricing(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := common.HexToAddress("0x00000000000000000000000000000000000000a1")
+	ev := abiVersions["v1"].Events["BoughtStorage"]
+	data, err := ev.Inputs.Pack(from, "jkl1user", uint64(30), uint64(1_000_000_000), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := testLog(from, 5, 0)
+	l.Address, l.Topics, l.Data = contract, []common.Hash{ev.ID}, data
+
+	journal, err := openWAL(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.close()
+	// executed on Jackal already, only the callback is left
+	err = journal.set(1, l, "message", walCommitted, "ABCD")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = handleLog(context.Background(), a.events, journal, f.bridge, &l, nil, a.q, 1, "jkl1contract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := journal.get(1, l).State; state != walCommitted {
+		t.Fatalf("log is %q before its batch went out, want it committed", state)
+	}
+
+	err = f.close(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := journal.get(1, l)
+	if entry.State != walFinished || entry.FinishedIn != 10 {
+		t.Errorf("recorded %+v, want the log finished in block 10", entry)
+	}
+}
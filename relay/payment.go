@@ -0,0 +1,214 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/JackalLabs/mulberry/config"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrUnderpaid is returned for paid events whose EVM payment doesn't cover what the relay pays on Jackal
+var ErrUnderpaid = errors.New("payment does not cover the jackal cost")
+
+// priceFeedDecimals is the number of decimals of the Chainlink USD feeds getPrice reads from
+const priceFeedDecimals = 8
+
+// payment is what was paid on the EVM side for an event and what relaying it costs, in USD
+type payment struct {
+	Value    *big.Int `json:"value"` // wei
+	EthPrice float64  `json:"eth_price"`
+	Paid     float64  `json:"paid"`
+	Cost     float64  `json:"cost"`
+	Required float64  `json:"required"`
+}
+
+// checkPayment makes sure a paid event was paid for before it is relayed, following the payment check setting.
+// messages are the entries the contract stored under the message ID of the log.
+func (b *bridgeReader) checkPayment(ctx context.Context, vLog *types.Log, event *relayedEvent, messages []bridgeMessage) error {
+	settings := b.a.cfg.MulberrySettings
+	if event.Cost == 0 || settings.PaymentCheck == config.PaymentCheckOff {
+		return nil
+	}
+	_, err := b.method(vLog.Address, "getPrice")
+	if errors.Is(err, errNoMethod) {
+		log.Printf("%s has no getPrice, not checking the payment of log %d of tx %s", vLog.Address.Hex(), vLog.Index, vLog.TxHash.Hex())
+		return nil
+	}
+
+	p, err := b.payment(ctx, vLog, event, messages, settings.PaymentMargin)
+	if err == nil {
+		return nil
+	}
+	if settings.PaymentCheck != config.PaymentCheckFlag {
+		return err
+	}
+
+	log.Printf("Relaying log %d of tx %s anyway: %v", vLog.Index, vLog.TxHash.Hex(), err)
+	errRecord := recordUnderpaid(b.a.home, b.network, *vLog, event, p, err)
+	if errRecord != nil {
+		log.Printf("Failed to record underpaid log: %v", errRecord)
+	}
+	return nil
+}
+
+// payment compares the value paid for a message, priced with the contract's getPrice, to the ujkl cost of the event
+// priced with the JKL price. The payment must cover the cost plus the margin.
+func (b *bridgeReader) payment(ctx context.Context, vLog *types.Log, event *relayedEvent, messages []bridgeMessage, margin float64) (*payment, error) {
+	paid, cost, err := b.paid(ctx, vLog, event, messages)
+	if err != nil {
+		return nil, err
+	}
+	costUSD, err := b.a.q.USDValue(cost)
+	if err != nil {
+		return nil, err
+	}
+
+	// the price the contract charged with, at the block of the payment
+	out, err := b.call(ctx, vLog.Address, vLog.BlockNumber, "getPrice")
+	if err != nil {
+		return nil, err
+	}
+	rawPrice, ok := out[0].(*big.Int)
+	if !ok || rawPrice.Sign() <= 0 {
+		return nil, fmt.Errorf("getPrice on %s returned %v", vLog.Address.Hex(), out[0])
+	}
+
+	ethPrice, _ := new(big.Float).Quo(new(big.Float).SetInt(rawPrice), big.NewFloat(math.Pow10(priceFeedDecimals))).Float64()
+	value, _ := new(big.Float).Quo(new(big.Float).SetInt(paid), big.NewFloat(1e18)).Float64()
+
+	p := payment{
+		Value:    paid,
+		EthPrice: ethPrice,
+		Paid:     value * ethPrice,
+		Cost:     costUSD,
+		Required: costUSD * (1 + margin),
+	}
+	if p.Paid < p.Required {
+		return &p, fmt.Errorf("paid $%f (%s wei at $%f/ETH), need $%f | %w", p.Paid, p.Value.String(), p.EthPrice, p.Required, ErrUnderpaid)
+	}
+	return &p, nil
+}
+
+// paid returns the wei paid for a message and the ujkl it has to cover. That is the value the contract stored with the message,
+// which is what was forwarded to the bridge even when the transaction went through another contract.
+// Logs that share a message ID can't be told apart in the messages array, so they are checked together:
+// the values of all their entries against the cost of all of them.
+// Contracts without values in their messages array fall back to the value sent with the transaction.
+func (b *bridgeReader) paid(ctx context.Context, vLog *types.Log, event *relayedEvent, messages []bridgeMessage) (*big.Int, int64, error) {
+	if len(messages) > 0 && messages[0].Value != nil {
+		value := new(big.Int)
+		for _, m := range messages {
+			if m.Value != nil {
+				value.Add(value, m.Value)
+			}
+		}
+		if len(messages) == 1 {
+			return value, event.Cost, nil
+		}
+
+		cost, err := b.sharedCost(ctx, vLog, event.MessageID(vLog.BlockNumber))
+		return value, cost, err
+	}
+
+	e, client, err := b.rpcs.get(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	tx, _, err := client.TransactionByHash(ctx, vLog.TxHash)
+	b.rpcs.report(e, err)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot get tx %s | %w", vLog.TxHash.Hex(), err)
+	}
+	return tx.Value(), event.Cost, nil
+}
+
+// sharedCost returns the ujkl cost of every log of a contract in the block of a log that has the same message ID
+func (b *bridgeReader) sharedCost(ctx context.Context, vLog *types.Log, messageID string) (int64, error) {
+	blockHash := vLog.BlockHash
+	logs, err := b.rpcs.filterLogs(ctx, ethereum.FilterQuery{Addresses: []common.Address{vLog.Address}, BlockHash: &blockHash}, b.network.Quorum)
+	if err != nil {
+		return 0, fmt.Errorf("cannot get logs of block %d | %w", vLog.BlockNumber, err)
+	}
+
+	var cost int64
+	for _, l := range logs {
+		if l.Removed {
+			continue
+		}
+		event, err := decodeLog(b.a.events, &l, b.a.w, b.a.q, b.network.ChainID)
+		if errors.Is(err, ErrUnknownEvent) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("cannot price log %d of tx %s | %w", l.Index, l.TxHash.Hex(), err)
+		}
+		if event.MessageID(l.BlockNumber) == messageID {
+			cost += event.Cost
+		}
+	}
+	return cost, nil
+}
+
+var underpaidMu sync.Mutex
+
+// underpaidLog is a record of a paid event that was relayed although its payment could not be verified
+type underpaidLog struct {
+	TxHash      string    `json:"tx_hash"`
+	Index       uint      `json:"index"`
+	BlockNumber uint64    `json:"block_number"`
+	Event       string    `json:"event"`
+	From        string    `json:"from"`
+	CostUjkl    int64     `json:"cost_ujkl"`
+	Payment     *payment  `json:"payment,omitempty"`
+	Error       string    `json:"error"`
+	Time        time.Time `json:"time"`
+}
+
+// recordUnderpaid appends a flagged log to underpaid/<chain_id>.jsonl in the home directory
+func recordUnderpaid(homePath string, network config.NetworkConfig, l types.Log, event *relayedEvent, p *payment, failure error) error {
+	underpaidMu.Lock()
+	defer underpaidMu.Unlock()
+
+	dir := path.Join(homePath, "underpaid")
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("cannot make the underpaid directory at %s | %w", dir, err)
+	}
+
+	data, err := json.Marshal(underpaidLog{
+		TxHash:      l.TxHash.Hex(),
+		Index:       l.Index,
+		BlockNumber: l.BlockNumber,
+		Event:       event.MessageType,
+		From:        event.EvmAddress,
+		CostUjkl:    event.Cost,
+		Payment:     p,
+		Error:       failure.Error(),
+		Time:        time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("cannot marshal underpaid log | %w", err)
+	}
+
+	f, err := os.OpenFile(path.Join(dir, fmt.Sprintf("%d.jsonl", network.ChainID)), os.O_APPEND|os.O_CREATE|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("cannot open underpaid record | %w", err)
+	}
+	//nolint:errcheck
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
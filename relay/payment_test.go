@@ -0,0 +1,105 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/JackalLabs/mulberry/config"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// boughtStorageLog returns a purchase of 1 GB for 30 days emitted by contract in block 5
+func boughtStorageLog(t *testing.T, contract common.Address, index uint) types.Log {
+	from := common.HexToAddress("0x00000000000000000000000000000000000000a1")
+	ev := abiVersions["v1"].Events["BoughtStorage"]
+	data, err := ev.Inputs.Pack(from, "jkl1user", uint64(30), uint64(1_000_000_000), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := testLog(from, 5, index)
+	l.Address, l.Topics, l.Data = contract, []common.Hash{ev.ID}, data
+	return l
+}
+
+func TestCheckPayment(t *testing.T) {
+	const ethPrice = 3000
+	a, network := testApp(t, rpcMethods{})
+	err := a.updatePricing(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract := common.HexToAddress(network.Contract)
+	b := testBridge(t, a, network, rpcMethods{})
+
+	// two purchases of one sender in one block share a message ID
+	first, second := boughtStorageLog(t, contract, 0), boughtStorageLog(t, contract, 1)
+	event, err := decodeLog(a.events, &first, nil, a.q, network.ChainID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	costUSD, err := a.q.USDValue(event.Cost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// wei paying share times the cost of one purchase
+	paying := func(share float64) *big.Int {
+		wei, _ := new(big.Float).Mul(big.NewFloat(costUSD/ethPrice*share), big.NewFloat(1e18)).Int(nil)
+		return wei
+	}
+	id := event.MessageID(first.BlockNumber)
+
+	cases := []struct {
+		name     string
+		check    string
+		margin   float64
+		messages []bridgeMessage
+		flagged  bool
+		err      error
+	}{
+		{name: "covered", messages: []bridgeMessage{{ID: id, Value: paying(1.01)}}},
+		{name: "underpaid", messages: []bridgeMessage{{ID: id, Value: paying(0.5)}}, err: ErrUnderpaid},
+		{name: "cost without the margin", margin: 0.1, messages: []bridgeMessage{{ID: id, Value: paying(1.05)}}, err: ErrUnderpaid},
+		{name: "cost with the margin", margin: 0.1, messages: []bridgeMessage{{ID: id, Value: paying(1.15)}}},
+		{name: "flagged", check: config.PaymentCheckFlag, messages: []bridgeMessage{{ID: id, Value: paying(0.5)}}, flagged: true},
+		{name: "not checked", check: config.PaymentCheckOff, messages: []bridgeMessage{{ID: id, Value: paying(0)}}},
+		{
+			// the entries of the message pay for both purchases together
+			name:     "shared message covered",
+			messages: []bridgeMessage{{ID: id, Value: paying(1.5)}, {ID: id, Value: paying(0.6)}},
+		},
+		{
+			// enough for the purchase checked, not for both
+			name:     "shared message underpaid",
+			messages: []bridgeMessage{{ID: id, Value: paying(1.5)}, {ID: id, Value: paying(0)}},
+			err:      ErrUnderpaid,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a.home = t.TempDir()
+			a.cfg.MulberrySettings = config.MulberrySettings{PaymentCheck: c.check, PaymentMargin: c.margin}
+			s := &stubBridge{head: 10, price: ethPrice * 1e8, logs: []types.Log{first, second}}
+			b.rpcs = stubRPC(t, s.methods())
+
+			err := b.checkPayment(context.Background(), &first, event, c.messages)
+			if !errors.Is(err, c.err) || (err != nil) != (c.err != nil) {
+				t.Fatalf("got error %v, want %v", err, c.err)
+			}
+
+			data, err := os.ReadFile(path.Join(a.home, "underpaid", "1.jsonl"))
+			if c.flagged != (err == nil) {
+				t.Fatalf("underpaid record: %v, want one: %t", err, c.flagged)
+			}
+			if c.flagged && !strings.Contains(string(data), first.TxHash.Hex()) {
+				t.Errorf("recorded %s, want the log", data)
+			}
+		})
+	}
+}
@@ -0,0 +1,309 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/JackalLabs/mulberry/jackal/uploader"
+	evmTypes "github.com/JackalLabs/mulberry/types"
+	"github.com/desmos-labs/cosmos-go-wallet/wallet"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// MsgEnv is what message builders can use besides the event itself
+type MsgEnv struct {
+	Wallet  *wallet.Wallet
+	Queue   *uploader.Queue
+	ChainID uint64
+}
+
+// EventHandler relays one contract event to Jackal
+type EventHandler interface {
+	// Signature is the canonical event signature, like "PostedKey(address,string)"
+	Signature() string
+	// Decode unpacks a log of the event
+	Decode(l types.Log) (any, error)
+	// BuildMsg builds the message for a decoded event, returning the EVM address it is executed for and the ujkl it needs
+	BuildMsg(env MsgEnv, event any) (string, *evmTypes.ExecuteMsg, int64, error)
+}
+
+// abiHandler is an EventHandler for an ABI event, unpacking the log data into E
+type abiHandler[E any] struct {
+	contractABI abi.ABI
+	event       abi.Event
+	build       func(env MsgEnv, event E) (string, *evmTypes.ExecuteMsg, int64, error)
+}
+
+// NewABIHandler returns an EventHandler for the named event of an ABI.
+// Logs are unpacked into E, which follows the same rules as abi.UnpackIntoInterface.
+func NewABIHandler[E any](contractABI abi.ABI, name string, build func(env MsgEnv, event E) (string, *evmTypes.ExecuteMsg, int64, error)) (EventHandler, error) {
+	ev, ok := contractABI.Events[name]
+	if !ok {
+		return nil, fmt.Errorf("event %s is not in the ABI", name)
+	}
+	return &abiHandler[E]{contractABI: contractABI, event: ev, build: build}, nil
+}
+
+func (h *abiHandler[E]) Signature() string {
+	return h.event.Sig
+}
+
+func (h *abiHandler[E]) Decode(l types.Log) (any, error) {
+	var event E
+	err := h.contractABI.UnpackIntoInterface(&event, h.event.Name, l.Data)
+	return event, err
+}
+
+func (h *abiHandler[E]) BuildMsg(env MsgEnv, event any) (string, *evmTypes.ExecuteMsg, int64, error) {
+	e, ok := event.(E)
+	if !ok {
+		return "", nil, 0, fmt.Errorf("%s cannot build a message for %T", h.event.Name, event)
+	}
+	return h.build(env, e)
+}
+
+// eventName returns the name part of an event signature
+func eventName(h EventHandler) string {
+	name, _, _ := strings.Cut(h.Signature(), "(")
+	return name
+}
+
+// bridgeEvent builds the handler of a bridge event for whichever ABI version a contract uses
+type bridgeEvent struct {
+	name    string
+	handler func(contractABI abi.ABI) (EventHandler, error)
+}
+
+func onBridgeEvent[E any](name string, build func(env MsgEnv, event E) (string, *evmTypes.ExecuteMsg, int64, error)) bridgeEvent {
+	return bridgeEvent{
+		name: name,
+		handler: func(contractABI abi.ABI) (EventHandler, error) {
+			return NewABIHandler(contractABI, name, build)
+		},
+	}
+}
+
+// bridgeEvents are the events of the bridge contract by name
+var bridgeEvents = map[string]bridgeEvent{}
+
+func init() {
+	for _, e := range []bridgeEvent{
+		onBridgeEvent("PostedFile", generatePostedFileMsg),
+		onBridgeEvent("BoughtStorage", generateBoughtStorageMsg),
+		onBridgeEvent("DeletedFile", generateDeletedFileMsg),
+		onBridgeEvent("RequestedReportForm", generateRequestedReportFormMsg),
+		onBridgeEvent("PostedKey", generatePostedKeyMsg),
+		onBridgeEvent("DeletedFileTree", generateDeletedFileTreeMsg),
+		onBridgeEvent("ProvisionedFileTree", generateProvisionedFiletreeMsg),
+		onBridgeEvent("PostedFileTree", generatePostedFileTreeMsg),
+		onBridgeEvent("AddedViewers", generateAddedViewersMsg),
+		onBridgeEvent("RemovedViewers", generateRemovedViewersMsg),
+		onBridgeEvent("ResetViewers", generateResetViewersMsg),
+		onBridgeEvent("ChangedOwner", generateChangedOwnerMsg),
+		onBridgeEvent("AddedEditors", generateAddedEditorsMsg),
+		onBridgeEvent("RemovedEditors", generateRemovedEditorsMsg),
+		onBridgeEvent("ResetEditors", generateResetEditorsMsg),
+		onBridgeEvent("CreatedNotification", generateCreatedNotificationMsg),
+		onBridgeEvent("DeletedNotification", generateDeletedNotificationMsg),
+		onBridgeEvent("BlockedSenders", generateBlockedSendersMsg),
+	} {
+		bridgeEvents[e.name] = e
+	}
+}
+
+// eventRegistry maps the event IDs (topic 0) of one contract to their handlers
+type eventRegistry struct {
+	abi      abi.ABI
+	handlers map[common.Hash]EventHandler
+}
+
+// newEventRegistry returns the handlers for every event of a contract ABI.
+// Custom handlers take precedence, the other events need to be one of events.
+func newEventRegistry(contractABI abi.ABI, events map[string]bridgeEvent, custom map[common.Hash]EventHandler) (*eventRegistry, error) {
+	r := eventRegistry{
+		abi:      contractABI,
+		handlers: make(map[common.Hash]EventHandler),
+	}
+
+	var unhandled []string
+	var errs []error
+	for name, ev := range contractABI.Events {
+		if h, ok := custom[ev.ID]; ok {
+			r.handlers[ev.ID] = h
+			continue
+		}
+
+		b, ok := events[name]
+		if !ok {
+			unhandled = append(unhandled, ev.Sig)
+			continue
+		}
+		h, err := b.handler(contractABI)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if h.Signature() != ev.Sig {
+			errs = append(errs, fmt.Errorf("handler of %s is for %s", ev.Sig, h.Signature()))
+			continue
+		}
+		r.handlers[ev.ID] = h
+	}
+
+	if len(unhandled) > 0 {
+		sort.Strings(unhandled)
+		errs = append(errs, fmt.Errorf("events in the ABI without a handler: %s", strings.Join(unhandled, ", ")))
+	}
+	return &r, errors.Join(errs...)
+}
+
+// contractKey identifies a contract across networks
+type contractKey struct {
+	chainID uint64
+	address common.Address
+}
+
+// eventRegistries holds the event handlers of every contract the relay watches
+type eventRegistries struct {
+	contracts map[contractKey]*eventRegistry
+}
+
+// get returns the handler for a log, based on the contract that emitted it
+func (r *eventRegistries) get(chainID uint64, l types.Log) (EventHandler, bool) {
+	if len(l.Topics) == 0 {
+		return nil, false
+	}
+	c, ok := r.contracts[contractKey{chainID: chainID, address: l.Address}]
+	if !ok {
+		return nil, false
+	}
+	h, ok := c.handlers[l.Topics[0]]
+	return h, ok
+}
+
+// contractABI returns the ABI a contract was configured with
+func (r *eventRegistries) contractABI(chainID uint64, address common.Address) (abi.ABI, bool) {
+	c, ok := r.contracts[contractKey{chainID: chainID, address: address}]
+	if !ok {
+		return abi.ABI{}, false
+	}
+	return c.abi, true
+}
+
+// loadEvents builds the event handlers of every configured contract from its ABI version.
+// It fails if a contract ABI has an event without a handler or a custom handler matches no contract ABI,
+// so the relay and the contracts can't silently drift apart.
+func (a *App) loadEvents() error {
+	custom := make(map[common.Hash]EventHandler)
+	for _, h := range a.handlers {
+		custom[crypto.Keccak256Hash([]byte(h.Signature()))] = h
+	}
+	used := make(map[common.Hash]bool)
+
+	events := eventRegistries{
+		contracts: make(map[contractKey]*eventRegistry),
+	}
+
+	var errs []error
+	for _, network := range a.cfg.NetworksConfig {
+		for _, c := range network.AllContracts() {
+			contractABI, err := a.contractABI(c.ABI)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: contract %s | %w", network.Name, c.Address, err))
+				continue
+			}
+
+			r, err := newEventRegistry(contractABI, bridgeEvents, custom)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: contract %s with ABI %s | %w", network.Name, c.Address, c.ABI, err))
+				continue
+			}
+			for id := range r.handlers {
+				used[id] = true
+			}
+
+			events.contracts[contractKey{chainID: network.ChainID, address: common.HexToAddress(c.Address)}] = r
+		}
+	}
+
+	var missing []string
+	for id, h := range custom {
+		if !used[id] {
+			missing = append(missing, h.Signature())
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		errs = append(errs, fmt.Errorf("handlers for events missing from every contract ABI: %s", strings.Join(missing, ", ")))
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	a.events = &events
+	return nil
+}
+
+// contractABI returns an ABI version shipped with the relay or registered with RegisterABI, otherwise it loads an ABI file.
+// Relative paths are read from the home directory.
+func (a *App) contractABI(version string) (abi.ABI, error) {
+	if contractABI, ok := abiVersions[version]; ok {
+		return contractABI, nil
+	}
+	if contractABI, ok := a.abis[version]; ok {
+		return contractABI, nil
+	}
+
+	p := version
+	if !path.IsAbs(p) {
+		p = path.Join(a.home, p)
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return abi.ABI{}, fmt.Errorf("%s is not a known ABI version and cannot be read | %w", version, err)
+	}
+	contractABI, err := abi.JSON(bytes.NewReader(data))
+	if err != nil {
+		return abi.ABI{}, fmt.Errorf("cannot parse ABI at %s | %w", p, err)
+	}
+	return contractABI, nil
+}
+
+// RegisterABI adds a contract ABI under a version name that contracts in the config can use, it can only be called before Start
+func (a *App) RegisterABI(version string, abiJSON string) error {
+	if a.started.Load() {
+		return errors.New("cannot register an ABI after the relay started")
+	}
+	if _, ok := abiVersions[version]; ok {
+		return fmt.Errorf("ABI version %s is shipped with the relay", version)
+	}
+	contractABI, err := abi.JSON(strings.NewReader(abiJSON))
+	if err != nil {
+		return fmt.Errorf("cannot parse ABI | %w", err)
+	}
+	a.abis[version] = contractABI
+	return nil
+}
+
+// RegisterHandler adds a handler for a custom event, it can only be called before Start.
+// It is used for that event on every contract whose ABI has it, taking precedence over the bridge handlers.
+func (a *App) RegisterHandler(h EventHandler) error {
+	if a.started.Load() {
+		return errors.New("cannot register a handler after the relay started")
+	}
+	for _, other := range a.handlers {
+		if other.Signature() == h.Signature() {
+			return fmt.Errorf("%s already has a handler", h.Signature())
+		}
+	}
+	a.handlers = append(a.handlers, h)
+	return nil
+}
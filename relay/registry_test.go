@@ -0,0 +1,99 @@
+package relay
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/JackalLabs/mulberry/config"
+	evmTypes "github.com/JackalLabs/mulberry/types"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// stubHandler is a custom handler of the event with its signature
+type stubHandler string
+
+func (h stubHandler) Signature() string { return string(h) }
+
+func (h stubHandler) Decode(types.Log) (any, error) { return nil, nil }
+
+func (h stubHandler) BuildMsg(MsgEnv, any) (string, *evmTypes.ExecuteMsg, int64, error) {
+	return "", nil, 0, nil
+}
+
+// writeABI writes the shipped ABI with events added to it to the home directory, returning its file name
+func writeABI(t *testing.T, home string, events ...string) string {
+	var entries []json.RawMessage
+	err := json.Unmarshal([]byte(ABI), &entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range events {
+		entries = append(entries, json.RawMessage(e))
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path.Join(home, "bridge.json"), data, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "bridge.json"
+}
+
+func TestLoadEventsDrift(t *testing.T) {
+	const tipped = `{"type":"event","name":"Tipped","inputs":[{"name":"from","type":"address","indexed":false},{"name":"amount","type":"uint64","indexed":false}],"anonymous":false}`
+
+	cases := []struct {
+		name     string
+		events   []string // events the contract has on top of the shipped ABI
+		handlers []EventHandler
+		err      string
+	}{
+		{name: "shipped ABI"},
+		{name: "event without a handler", events: []string{tipped}, err: "events in the ABI without a handler: Tipped(address,uint64)"},
+		{name: "custom handler of a new event", events: []string{tipped}, handlers: []EventHandler{stubHandler("Tipped(address,uint64)")}},
+		{
+			name:     "custom handler of an event no contract emits",
+			handlers: []EventHandler{stubHandler("Tipped(address,uint64)")},
+			err:      "handlers for events missing from every contract ABI: Tipped(address,uint64)",
+		},
+		{
+			// a bridge that changed the layout of an event emits it under another ID
+			name:     "custom handler of an old layout",
+			handlers: []EventHandler{stubHandler("PostedKey(address,string,uint64)")},
+			err:      "missing from every contract ABI: PostedKey(address,string,uint64)",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a := &App{home: t.TempDir(), handlers: c.handlers}
+			network := config.NetworkConfig{Name: "test", ChainID: 1, Contract: "0x5FbDB2315678afecb367f032d93F642f64180aa3"}
+			if len(c.events) > 0 {
+				network.ContractABI = writeABI(t, a.home, c.events...)
+			}
+			a.cfg = config.Config{NetworksConfig: []config.NetworkConfig{network}}
+
+			err := a.loadEvents()
+			if len(c.err) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(a.events.contracts) != 1 {
+					t.Errorf("loaded %d contracts, want 1", len(a.events.contracts))
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("got error %v, want %q", err, c.err)
+			}
+			if a.events != nil {
+				t.Error("events were loaded although the ABIs drifted")
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/JackalLabs/mulberry/config"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+var dropMu sync.Mutex
+
+// droppedLog is a record of a log that was never relayed because it left the canonical chain
+type droppedLog struct {
+	TxHash      string    `json:"tx_hash"`
+	Index       uint      `json:"index"`
+	BlockNumber uint64    `json:"block_number"`
+	BlockHash   string    `json:"block_hash"`
+	Reason      string    `json:"reason"`
+	Time        time.Time `json:"time"`
+}
+
+// recordDrop appends a dropped log to reorgs/<chain_id>.jsonl in the home directory
+func recordDrop(homePath string, network config.NetworkConfig, l types.Log, reason string) error {
+	dropMu.Lock()
+	defer dropMu.Unlock()
+
+	dir := path.Join(homePath, "reorgs")
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("cannot make the reorg directory at %s | %w", dir, err)
+	}
+
+	data, err := json.Marshal(droppedLog{
+		TxHash:      l.TxHash.Hex(),
+		Index:       l.Index,
+		BlockNumber: l.BlockNumber,
+		BlockHash:   l.BlockHash.Hex(),
+		Reason:      reason,
+		Time:        time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("cannot marshal dropped log | %w", err)
+	}
+
+	f, err := os.OpenFile(path.Join(dir, fmt.Sprintf("%d.jsonl", network.ChainID)), os.O_APPEND|os.O_CREATE|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("cannot open reorg record | %w", err)
+	}
+	//nolint:errcheck
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// blockRef is the number, hash and time of a block as reported by the node
+type blockRef struct {
+	Number    hexutil.Uint64 `json:"number"`
+	Hash      common.Hash    `json:"hash"`
+	Timestamp hexutil.Uint64 `json:"timestamp"`
+}
+
+// blockAt returns the block at a height or tag ("safe", "finalized", "latest").
+// The hash is read from the RPC response instead of recomputed from the header so L2 header formats don't matter.
+func blockAt(ctx context.Context, client *ethclient.Client, tag string) (blockRef, error) {
+	var head *blockRef
+	err := client.Client().CallContext(ctx, &head, "eth_getBlockByNumber", tag, false)
+	if err != nil {
+		return blockRef{}, err
+	}
+	if head == nil {
+		return blockRef{}, fmt.Errorf("block %s not found", tag)
+	}
+	return *head, nil
+}
+
+// blockHashAt returns the canonical block hash at a height
+func blockHashAt(ctx context.Context, client *ethclient.Client, number uint64) (common.Hash, error) {
+	head, err := blockAt(ctx, client, hexutil.EncodeBig(new(big.Int).SetUint64(number)))
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return head.Hash, nil
+}
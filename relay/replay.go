@@ -0,0 +1,167 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/JackalLabs/mulberry/config"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// ReplayOptions selects the logs to relay again, either the logs of one transaction or of a block range
+type ReplayOptions struct {
+	Network   string // network name or chain id
+	TxHash    string
+	FromBlock uint64
+	ToBlock   uint64
+	DryRun    bool // print the messages instead of broadcasting them
+}
+
+// Replay fetches the bridge logs of a transaction or block range and runs them through the relay pipeline.
+// Finality and the checkpoint are skipped, the logs are relayed as they are now.
+func (a *App) Replay(ctx context.Context, opts ReplayOptions) error {
+	network, err := a.findNetwork(opts.Network)
+	if err != nil {
+		return err
+	}
+
+	err = a.loadEvents()
+	if err != nil {
+		return err
+	}
+
+	rpcs := newEndpointPool(append([]string{network.RPC}, network.RPCEndpoints...)...)
+	defer rpcs.Close()
+
+	var logs []types.Log
+	if len(opts.TxHash) > 0 {
+		logs, err = txLogs(ctx, rpcs, network, common.HexToHash(opts.TxHash))
+	} else {
+		logs, err = rangeLogs(ctx, rpcs, network, opts.FromBlock, opts.ToBlock)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Found %d logs to replay on %s", len(logs), network.Name)
+
+	err = a.updatePricing(ctx)
+	if err != nil {
+		return err
+	}
+
+	if opts.DryRun {
+		for _, l := range logs {
+			event, err := decodeLog(a.events, &l, a.w, a.q, network.ChainID)
+			if err != nil {
+				fmt.Printf("tx %s log %d: %s\n", l.TxHash.Hex(), l.Index, err.Error())
+				continue
+			}
+			factoryMsg := event.FactoryMsg()
+			fmt.Printf("tx %s log %d (%s, %d ujkl):\n%s\n", l.TxHash.Hex(), l.Index, event.MessageType, event.Cost, factoryMsg.ToString())
+		}
+		return nil
+	}
+
+	err = a.lockWAL()
+	if err != nil {
+		return err
+	}
+	defer a.unlockWAL()
+
+	a.q.Listen()
+	defer func() {
+		stopCtx, cancel := context.WithTimeout(context.Background(), a.shutdownTimeout())
+		defer cancel()
+		err := a.q.Stop(stopCtx)
+		if err != nil {
+			log.Printf("cannot drain the jackal queue | %s", err.Error())
+		}
+	}()
+
+	bridge := a.bridgeReader(network, rpcs)
+	var errs []error
+	for _, l := range logs {
+		if ctx.Err() != nil {
+			return errors.Join(append(errs, ctx.Err())...)
+		}
+		postCtx, cancel := context.WithTimeout(ctx, a.postTimeout())
+		err := handleLog(postCtx, a.events, a.wal, bridge, &l, a.w, a.q, network.ChainID, a.cfg.JackalConfig.Contract)
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("log %d of tx %s | %w", l.Index, l.TxHash.Hex(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// findNetwork looks up a configured network by name or chain id
+func (a *App) findNetwork(name string) (config.NetworkConfig, error) {
+	for _, network := range a.cfg.NetworksConfig {
+		if strings.EqualFold(network.Name, name) || strconv.FormatUint(network.ChainID, 10) == name {
+			return network, nil
+		}
+	}
+	return config.NetworkConfig{}, fmt.Errorf("network %s is not configured", name)
+}
+
+// txLogs returns the logs a transaction emitted from the contracts of a network
+func txLogs(ctx context.Context, rpcs *endpointPool, network config.NetworkConfig, txHash common.Hash) ([]types.Log, error) {
+	e, client, err := rpcs.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	receipt, err := client.TransactionReceipt(ctx, txHash)
+	rpcs.report(e, err)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get receipt of %s | %w", txHash.Hex(), err)
+	}
+
+	contracts := make(map[common.Address]bool)
+	for _, address := range contractAddresses(network) {
+		contracts[address] = true
+	}
+
+	var logs []types.Log
+	for _, l := range receipt.Logs {
+		if contracts[l.Address] {
+			logs = append(logs, *l)
+		}
+	}
+	return logs, nil
+}
+
+// rangeLogs returns the logs of the contracts of a network between two blocks, both included
+func rangeLogs(ctx context.Context, rpcs *endpointPool, network config.NetworkConfig, from uint64, to uint64) ([]types.Log, error) {
+	if from == 0 || to < from {
+		return nil, fmt.Errorf("invalid block range %d-%d", from, to)
+	}
+
+	var logs []types.Log
+	step := backfillRange(network)
+	for start := from; start <= to; start += step {
+		end := start + step - 1
+		if end > to {
+			end = to
+		}
+
+		q := ethereum.FilterQuery{
+			Addresses: contractAddresses(network),
+			FromBlock: new(big.Int).SetUint64(start),
+			ToBlock:   new(big.Int).SetUint64(end),
+		}
+		l, err := rpcs.filterLogs(ctx, q, network.Quorum)
+		if err != nil {
+			return nil, fmt.Errorf("cannot get logs of blocks %d-%d | %w", start, end, err)
+		}
+		logs = append(logs, l...)
+	}
+	return logs, nil
+}
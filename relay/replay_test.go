@@ -0,0 +1,107 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/JackalLabs/mulberry/config"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestRangeLogs(t *testing.T) {
+	network := config.NetworkConfig{
+		ChainID:       1,
+		Contract:      "0x5FbDB2315678afecb367f032d93F642f64180aa3",
+		Contracts:     []config.ContractConfig{{Address: "0x00000000000000000000000000000000000000c2"}},
+		BackfillRange: 10,
+	}
+
+	cases := []struct {
+		name   string
+		from   uint64
+		to     uint64
+		ranges []string
+		err    bool
+	}{
+		{name: "split by the backfill range", from: 5, to: 27, ranges: []string{"5-14", "15-24", "25-27"}},
+		{name: "one block", from: 7, to: 7, ranges: []string{"7-7"}},
+		{name: "no start", from: 0, to: 7, err: true},
+		{name: "backwards", from: 8, to: 7, err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var ranges []string
+			rpcs := stubRPC(t, rpcMethods{"eth_getLogs": func(params []json.RawMessage) (any, error) {
+				var q struct {
+					Addresses []common.Address `json:"address"`
+					FromBlock hexutil.Uint64   `json:"fromBlock"`
+					ToBlock   hexutil.Uint64   `json:"toBlock"`
+				}
+				err := json.Unmarshal(params[0], &q)
+				if err != nil {
+					return nil, err
+				}
+				if len(q.Addresses) != 2 {
+					return nil, fmt.Errorf("filtered %v, want both contracts", q.Addresses)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				ranges = append(ranges, fmt.Sprintf("%d-%d", q.FromBlock, q.ToBlock))
+
+				l := testLog(common.HexToAddress("0x1"), uint64(q.FromBlock), 0)
+				l.Address = q.Addresses[0]
+				return []types.Log{l}, nil
+			}})
+
+			logs, err := rangeLogs(context.Background(), rpcs, network, c.from, c.to)
+			if (err != nil) != c.err {
+				t.Fatalf("got error %v, want one: %t", err, c.err)
+			}
+			if fmt.Sprint(ranges) != fmt.Sprint(c.ranges) {
+				t.Errorf("fetched %v, want %v", ranges, c.ranges)
+			}
+			if len(logs) != len(c.ranges) {
+				t.Errorf("got %d logs, want one per range", len(logs))
+			}
+		})
+	}
+}
+
+func TestTxLogs(t *testing.T) {
+	network := config.NetworkConfig{ChainID: 1, Contract: "0x5FbDB2315678afecb367f032d93F642f64180aa3"}
+	contract := common.HexToAddress(network.Contract)
+
+	// the transaction went through another contract that emitted a log of its own
+	bridged, other := testLog(common.HexToAddress("0x1"), 5, 1), testLog(common.HexToAddress("0x1"), 5, 0)
+	bridged.Address, other.Address = contract, common.HexToAddress("0x00000000000000000000000000000000000000c2")
+	receipt := &types.Receipt{Status: types.ReceiptStatusSuccessful, TxHash: bridged.TxHash, Logs: []*types.Log{&other, &bridged}}
+
+	rpcs := stubRPC(t, rpcMethods{"eth_getTransactionReceipt": func(params []json.RawMessage) (any, error) {
+		var hash common.Hash
+		err := json.Unmarshal(params[0], &hash)
+		if err != nil || hash != bridged.TxHash {
+			return nil, nil
+		}
+		return receipt, nil
+	}})
+
+	logs, err := txLogs(context.Background(), rpcs, network, bridged.TxHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 || logs[0].Address != contract || logs[0].Index != 1 {
+		t.Errorf("got %v, want the log of the bridge", logs)
+	}
+
+	_, err = txLogs(context.Background(), rpcs, network, common.HexToHash("0x01"))
+	if err == nil {
+		t.Error("got logs of a transaction that doesn't exist")
+	}
+}
@@ -0,0 +1,120 @@
+package relay
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/JackalLabs/mulberry/config"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+var (
+	// ErrTxReverted is returned when a transaction was mined but reverted
+	ErrTxReverted = errors.New("transaction reverted")
+	// ErrNoReceipt is returned when a transaction was sent but not mined before the deadline
+	ErrNoReceipt = errors.New("transaction was not mined in time")
+)
+
+// finishTimeout is how long finishing a message is tried for, bumping its fees while it is stuck
+const finishTimeout = 10 * time.Minute
+
+// SendError is returned when a transaction to an EVM contract fails
+type SendError struct {
+	Method string
+	TxHash common.Hash // empty if the transaction was never sent
+	Err    error
+}
+
+func (e *SendError) Error() string {
+	if e.TxHash == (common.Hash{}) {
+		return fmt.Sprintf("cannot send %s | %s", e.Method, e.Err.Error())
+	}
+	return fmt.Sprintf("%s in %s failed | %s", e.Method, e.TxHash.Hex(), e.Err.Error())
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// evmSender holds the EVM key of the relay and a transaction manager per network
+type evmSender struct {
+	key  *ecdsa.PrivateKey
+	from common.Address
+
+	mu       sync.Mutex
+	managers map[uint64]*txManager
+}
+
+func newEVMSender(key *ecdsa.PrivateKey) *evmSender {
+	return &evmSender{
+		key:      key,
+		from:     crypto.PubkeyToAddress(key.PublicKey),
+		managers: make(map[uint64]*txManager),
+	}
+}
+
+// manager returns the transaction manager of a network, every sender of the network shares its nonces
+func (s *evmSender) manager(network config.NetworkConfig) *txManager {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.managers[network.ChainID]
+	if !ok {
+		m = newTxManager(s.key, s.from, network)
+		s.managers[network.ChainID] = m
+	}
+	return m
+}
+
+// finishMessage removes a message from the messages array of the contract that emitted a log, once it was executed on Jackal
+func (b *bridgeReader) finishMessage(ctx context.Context, contract common.Address, id string) (*types.Receipt, error) {
+	return b.send(ctx, contract, "finishMessage", id)
+}
+
+// queueFinish hands the finishMessage call of a message to the batcher, done is called once its batch went out.
+// It returns false if the message is not batched and must be finished with finishMessage.
+func (b *bridgeReader) queueFinish(contract common.Address, id string, done func(*types.Receipt, error)) bool {
+	if b.batcher == nil {
+		return false
+	}
+	if _, err := b.method(contract, "finishMessage"); err != nil {
+		return false
+	}
+	b.batcher.add(contract, id, done)
+	return true
+}
+
+// send calls a function of a contract in a transaction from the relay
+func (b *bridgeReader) send(ctx context.Context, contract common.Address, name string, args ...any) (*types.Receipt, error) {
+	data, err := b.pack(contract, name, args...)
+	if err != nil {
+		return nil, &SendError{Method: name, Err: err}
+	}
+	return b.a.sender.manager(b.network).send(ctx, b.rpcs, name, contract, data)
+}
+
+// pack returns the calldata of a function of a contract
+func (b *bridgeReader) pack(contract common.Address, name string, args ...any) ([]byte, error) {
+	m, err := b.method(contract, name)
+	if err != nil {
+		return nil, err
+	}
+	return packCall(m, args...)
+}
+
+// packCall returns the calldata of a call to m. The selector is copied, m.ID shares its array with the whole
+// signature hash and appending to it in place would race with every other call packed for m.
+func packCall(m abi.Method, args ...any) ([]byte, error) {
+	input, err := m.Inputs.Pack(args...)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, m.ID...), input...), nil
+}
@@ -0,0 +1,354 @@
+package relay
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JackalLabs/mulberry/config"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrFeeCap is returned when a transaction can't be sent or bumped without going over the max fee of the network
+var ErrFeeCap = errors.New("transaction fee is over the cap")
+
+const (
+	defaultBumpInterval = time.Minute
+	// bumpPercent raises the fees of a stuck transaction, nodes ask for at least 10% to replace one
+	bumpPercent = 15
+	// gasHeadroomPercent is added to the gas estimate, the cost of finishMessage grows with the state it reads
+	gasHeadroomPercent = 20
+	receiptPolling     = 2 * time.Second
+	maxSendBackoff     = 30 * time.Second
+)
+
+// txManager sends the transactions of the relay on one network. Nonces are handed out locally so transactions sent at once
+// don't collide, fees follow EIP-1559 where the network supports it, and stuck transactions are replaced with higher fees.
+type txManager struct {
+	key     *ecdsa.PrivateKey
+	from    common.Address
+	chainID *big.Int
+	signer  types.Signer
+
+	maxFee       *big.Int // wei per transaction, nil for no cap
+	bumpInterval time.Duration
+
+	// mu is held while a transaction is signed and handed to the node, so nonces are used in order
+	mu        sync.Mutex
+	nonce     uint64
+	nonceSync bool
+}
+
+func newTxManager(key *ecdsa.PrivateKey, from common.Address, network config.NetworkConfig) *txManager {
+	chainID := new(big.Int).SetUint64(network.ChainID)
+	m := txManager{
+		key:          key,
+		from:         from,
+		chainID:      chainID,
+		signer:       types.LatestSignerForChainID(chainID),
+		bumpInterval: time.Duration(network.TxBumpInterval) * time.Second,
+	}
+	if m.bumpInterval == 0 {
+		m.bumpInterval = defaultBumpInterval
+	}
+	if network.MaxTxFee > 0 {
+		m.maxFee = new(big.Int).Mul(new(big.Int).SetUint64(network.MaxTxFee), big.NewInt(params.GWei))
+	}
+	return &m
+}
+
+// fees is the gas price of a transaction, legacy networks only use feeCap
+type fees struct {
+	tip    *big.Int
+	feeCap *big.Int
+	legacy bool
+}
+
+// send signs a call to a contract and waits for it to be mined, replacing it with higher fees while it is stuck
+func (m *txManager) send(ctx context.Context, rpcs *endpointPool, method string, to common.Address, data []byte) (*types.Receipt, error) {
+	msg := ethereum.CallMsg{From: m.from, To: &to, Data: data}
+
+	tx, f, err := m.sendNew(ctx, rpcs, msg)
+	if err != nil {
+		return nil, &SendError{Method: method, Err: err}
+	}
+	log.Printf("Sent %s in %s with nonce %d", method, tx.Hash().Hex(), tx.Nonce())
+
+	// every version of the transaction can still be mined, the receipt of any of them settles it
+	sent := []*types.Transaction{tx}
+	bump := time.NewTimer(m.bumpInterval)
+	defer bump.Stop()
+	poll := time.NewTicker(receiptPolling)
+	defer poll.Stop()
+
+	for {
+		receipt, err := findReceipt(ctx, rpcs, sent)
+		if err != nil {
+			return nil, &SendError{Method: method, TxHash: tx.Hash(), Err: err}
+		}
+		if receipt != nil {
+			if receipt.Status != types.ReceiptStatusSuccessful {
+				return receipt, &SendError{Method: method, TxHash: receipt.TxHash, Err: ErrTxReverted}
+			}
+			return receipt, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			// the transaction may never be mined, the next one starts over from the node's nonce so it can't leave a gap
+			m.resetNonce()
+			return nil, &SendError{Method: method, TxHash: tx.Hash(), Err: fmt.Errorf("%w | %w", ErrNoReceipt, ctx.Err())}
+		case <-poll.C:
+		case <-bump.C:
+			replacement, bumped, err := m.replace(ctx, rpcs, tx, f)
+			if err != nil {
+				log.Printf("Cannot replace %s in %s: %v", method, tx.Hash().Hex(), err)
+			} else {
+				log.Printf("Replaced stuck %s in %s with %s", method, tx.Hash().Hex(), replacement.Hash().Hex())
+				tx, f = replacement, bumped
+				sent = append(sent, tx)
+			}
+			bump.Reset(m.bumpInterval)
+		}
+	}
+}
+
+// sendNew sends a transaction with the next nonce, trying again with backoff until the node takes it or ctx is done
+func (m *txManager) sendNew(ctx context.Context, rpcs *endpointPool, msg ethereum.CallMsg) (*types.Transaction, fees, error) {
+	backoff := time.Second
+	for {
+		tx, f, err := m.trySend(ctx, rpcs, msg)
+		if err == nil || isRevert(err) || errors.Is(err, ErrFeeCap) {
+			return tx, f, err
+		}
+
+		log.Printf("Cannot send transaction, trying again in %s: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return nil, fees{}, fmt.Errorf("%w | %w", err, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxSendBackoff {
+			backoff = maxSendBackoff
+		}
+	}
+}
+
+func (m *txManager) trySend(ctx context.Context, rpcs *endpointPool, msg ethereum.CallMsg) (*types.Transaction, fees, error) {
+	e, client, err := rpcs.get(ctx)
+	if err != nil {
+		return nil, fees{}, err
+	}
+
+	gas, err := client.EstimateGas(ctx, msg)
+	if err != nil {
+		rpcs.report(e, ignoreRevert(err))
+		return nil, fees{}, fmt.Errorf("cannot estimate gas | %w", err)
+	}
+	gas = withHeadroom(gas)
+	f, err := m.suggestFees(ctx, client)
+	if err != nil {
+		rpcs.report(e, err)
+		return nil, fees{}, err
+	}
+	f, err = m.capFees(f, gas)
+	if err != nil {
+		return nil, fees{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.nonceSync {
+		err = m.syncNonce(ctx, client)
+		if err != nil {
+			rpcs.report(e, err)
+			return nil, fees{}, err
+		}
+	}
+
+	tx, err := m.sign(m.nonce, gas, msg, f)
+	if err != nil {
+		return nil, fees{}, err
+	}
+	err = client.SendTransaction(ctx, tx)
+	if isNonceError(err) {
+		// another sender used the key, start over from what the node knows
+		m.nonceSync = false
+	}
+	rpcs.report(e, ignoreRevert(err))
+	if err != nil && !isKnownTx(err) && !maybeSent(err) {
+		return nil, fees{}, err
+	}
+	if maybeSent(err) {
+		// the node may have taken it, it is tracked like any other and replacing it sends it again with the same nonce
+		log.Printf("Transaction %s with nonce %d may not have reached the node: %v", tx.Hash().Hex(), tx.Nonce(), err)
+	}
+
+	m.nonce++
+	return tx, f, nil
+}
+
+// replace sends the same transaction again with higher fees
+func (m *txManager) replace(ctx context.Context, rpcs *endpointPool, tx *types.Transaction, f fees) (*types.Transaction, fees, error) {
+	bumped := fees{tip: raise(f.tip), feeCap: raise(f.feeCap), legacy: f.legacy}
+
+	e, client, err := rpcs.get(ctx)
+	if err != nil {
+		return nil, fees{}, err
+	}
+	// the base fee may have moved past the bump
+	suggested, err := m.suggestFees(ctx, client)
+	if err == nil && suggested.feeCap.Cmp(bumped.feeCap) > 0 {
+		bumped.feeCap = suggested.feeCap
+	}
+	// so may the gas the call needs, the limit is never lowered in case the estimate is off
+	msg := ethereum.CallMsg{From: m.from, To: tx.To(), Data: tx.Data()}
+	gas := tx.Gas()
+	estimate, err := client.EstimateGas(ctx, msg)
+	if err == nil && withHeadroom(estimate) > gas {
+		gas = withHeadroom(estimate)
+	}
+
+	bumped, err = m.capFees(bumped, gas)
+	if err != nil {
+		return nil, fees{}, err
+	}
+	if bumped.feeCap.Cmp(raise(f.feeCap)) < 0 {
+		return nil, fees{}, fmt.Errorf("cannot raise the fees by %d%% | %w", bumpPercent, ErrFeeCap)
+	}
+
+	replacement, err := m.sign(tx.Nonce(), gas, msg, bumped)
+	if err != nil {
+		return nil, fees{}, err
+	}
+	err = client.SendTransaction(ctx, replacement)
+	rpcs.report(e, ignoreRevert(err))
+	if err != nil && !isKnownTx(err) && !maybeSent(err) {
+		return nil, fees{}, err
+	}
+	return replacement, bumped, nil
+}
+
+// suggestFees returns EIP-1559 fees of twice the base fee plus the suggested tip, or the suggested gas price on legacy networks
+func (m *txManager) suggestFees(ctx context.Context, client *ethclient.Client) (fees, error) {
+	head, err := client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return fees{}, fmt.Errorf("cannot get the latest header | %w", err)
+	}
+
+	if head.BaseFee == nil {
+		gasPrice, err := client.SuggestGasPrice(ctx)
+		if err != nil {
+			return fees{}, fmt.Errorf("cannot get gas price | %w", err)
+		}
+		return fees{tip: gasPrice, feeCap: gasPrice, legacy: true}, nil
+	}
+
+	tip, err := client.SuggestGasTipCap(ctx)
+	if err != nil {
+		return fees{}, fmt.Errorf("cannot get gas tip | %w", err)
+	}
+	feeCap := new(big.Int).Add(new(big.Int).Mul(head.BaseFee, big.NewInt(2)), tip)
+	return fees{tip: tip, feeCap: feeCap}, nil
+}
+
+// capFees lowers the fee cap so gas * feeCap stays under the max fee of the network
+func (m *txManager) capFees(f fees, gas uint64) (fees, error) {
+	if m.maxFee == nil {
+		return f, nil
+	}
+	limit := new(big.Int).Div(m.maxFee, new(big.Int).SetUint64(gas))
+	if f.feeCap.Cmp(limit) <= 0 {
+		return f, nil
+	}
+	if f.legacy || f.tip.Cmp(limit) > 0 {
+		return fees{}, fmt.Errorf("%d gas at %s wei is more than %s wei | %w", gas, f.feeCap.String(), m.maxFee.String(), ErrFeeCap)
+	}
+	return fees{tip: f.tip, feeCap: limit}, nil
+}
+
+func (m *txManager) sign(nonce uint64, gas uint64, msg ethereum.CallMsg, f fees) (*types.Transaction, error) {
+	var data types.TxData
+	if f.legacy {
+		data = &types.LegacyTx{Nonce: nonce, GasPrice: f.feeCap, Gas: gas, To: msg.To, Value: big.NewInt(0), Data: msg.Data}
+	} else {
+		data = &types.DynamicFeeTx{ChainID: m.chainID, Nonce: nonce, GasTipCap: f.tip, GasFeeCap: f.feeCap, Gas: gas, To: msg.To, Value: big.NewInt(0), Data: msg.Data}
+	}
+	return types.SignTx(types.NewTx(data), m.signer, m.key)
+}
+
+func (m *txManager) syncNonce(ctx context.Context, client *ethclient.Client) error {
+	nonce, err := client.PendingNonceAt(ctx, m.from)
+	if err != nil {
+		return fmt.Errorf("cannot get nonce | %w", err)
+	}
+	m.nonce = nonce
+	m.nonceSync = true
+	return nil
+}
+
+// resetNonce makes the next transaction take its nonce from the node again
+func (m *txManager) resetNonce() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nonceSync = false
+}
+
+// findReceipt returns the receipt of whichever version of a transaction was mined, nil if none was yet
+func findReceipt(ctx context.Context, rpcs *endpointPool, sent []*types.Transaction) (*types.Receipt, error) {
+	e, client, err := rpcs.get(ctx)
+	if err != nil {
+		return nil, nil // the endpoints may come back, the caller keeps polling until its deadline
+	}
+	for _, tx := range sent {
+		receipt, err := client.TransactionReceipt(ctx, tx.Hash())
+		if errors.Is(err, ethereum.NotFound) {
+			continue
+		}
+		rpcs.report(e, err)
+		if err != nil {
+			return nil, nil
+		}
+		return receipt, nil
+	}
+	return nil, nil
+}
+
+// withHeadroom adds gasHeadroomPercent to a gas estimate
+func withHeadroom(gas uint64) uint64 {
+	return gas + gas*gasHeadroomPercent/100
+}
+
+// raise adds bumpPercent to a fee
+func raise(fee *big.Int) *big.Int {
+	bumped := new(big.Int).Mul(fee, big.NewInt(100+bumpPercent))
+	return bumped.Div(bumped, big.NewInt(100))
+}
+
+func isNonceError(err error) bool {
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), "nonce too low")
+}
+
+// maybeSent reports if a transaction failed to send without the node answering, it may still have taken it
+func maybeSent(err error) bool {
+	var rpcErr rpc.Error
+	return err != nil && !errors.As(err, &rpcErr)
+}
+
+// isKnownTx reports if the node already has the transaction, it was sent before
+func isKnownTx(err error) bool {
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), "already known")
+}
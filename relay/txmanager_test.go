@@ -0,0 +1,224 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/JackalLabs/mulberry/config"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+func gwei(n float64) *big.Int {
+	v, _ := new(big.Float).Mul(big.NewFloat(n), big.NewFloat(params.GWei)).Int(nil)
+	return v
+}
+
+// latestHeader answers eth_getBlockByNumber with a header carrying baseFee
+func latestHeader(baseFee *big.Int) func([]json.RawMessage) (any, error) {
+	return func([]json.RawMessage) (any, error) {
+		return &types.Header{Number: big.NewInt(100), Difficulty: big.NewInt(0), BaseFee: baseFee}, nil
+	}
+}
+
+func TestCapFees(t *testing.T) {
+	const gas = 100_000
+
+	cases := []struct {
+		name   string
+		maxFee uint64 // gwei per transaction
+		f      fees
+		want   *big.Int
+		err    error
+	}{
+		{name: "no cap", f: fees{tip: gwei(1), feeCap: gwei(50)}, want: gwei(50)},
+		{name: "under the cap", maxFee: 5_000_000, f: fees{tip: gwei(1), feeCap: gwei(50)}, want: gwei(50)},
+		{name: "fee cap lowered", maxFee: 2_000_000, f: fees{tip: gwei(1), feeCap: gwei(50)}, want: gwei(20)},
+		{name: "tip over the cap", maxFee: 2_000_000, f: fees{tip: gwei(30), feeCap: gwei(50)}, err: ErrFeeCap},
+		{name: "legacy over the cap", maxFee: 2_000_000, f: fees{tip: gwei(50), feeCap: gwei(50), legacy: true}, err: ErrFeeCap},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := newTxManager(nil, common.Address{}, config.NetworkConfig{ChainID: 1, MaxTxFee: c.maxFee})
+			f, err := m.capFees(c.f, gas)
+			if !errors.Is(err, c.err) {
+				t.Fatalf("got error %v, want %v", err, c.err)
+			}
+			if c.err != nil {
+				return
+			}
+			if f.feeCap.Cmp(c.want) != 0 || f.tip.Cmp(c.f.tip) != 0 {
+				t.Errorf("got fee cap %s and tip %s, want %s and %s", f.feeCap, f.tip, c.want, c.f.tip)
+			}
+		})
+	}
+}
+
+func TestReplace(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	to := common.HexToAddress("0x5FbDB2315678afecb367f032d93F642f64180aa3")
+
+	sent := func([]json.RawMessage) (any, error) { return common.Hash{}, nil }
+
+	cases := []struct {
+		name    string
+		maxFee  uint64
+		methods rpcMethods
+		tip     *big.Int
+		feeCap  *big.Int
+		gas     uint64
+		err     error
+	}{
+		{
+			name:    "fees raised",
+			methods: rpcMethods{"eth_sendRawTransaction": sent},
+			tip:     gwei(1.15),
+			feeCap:  gwei(11.5),
+			gas:     100_000,
+		},
+		{
+			name: "call needs more gas",
+			methods: rpcMethods{
+				"eth_estimateGas":        returns(hexutil.Uint64(150_000)),
+				"eth_sendRawTransaction": sent,
+			},
+			tip:    gwei(1.15),
+			feeCap: gwei(11.5),
+			gas:    180_000,
+		},
+		{
+			name: "call needs less gas",
+			methods: rpcMethods{
+				"eth_estimateGas":        returns(hexutil.Uint64(50_000)),
+				"eth_sendRawTransaction": sent,
+			},
+			tip:    gwei(1.15),
+			feeCap: gwei(11.5),
+			gas:    100_000,
+		},
+		{
+			name: "base fee moved past the bump",
+			methods: rpcMethods{
+				"eth_getBlockByNumber":     latestHeader(gwei(20)),
+				"eth_maxPriorityFeePerGas": func([]json.RawMessage) (any, error) { return (*hexutil.Big)(gwei(1)), nil },
+				"eth_sendRawTransaction":   sent,
+			},
+			tip:    gwei(1.15),
+			feeCap: gwei(41),
+			gas:    100_000,
+		},
+		{
+			name:    "over the cap",
+			maxFee:  1_100_000,
+			methods: rpcMethods{"eth_sendRawTransaction": sent},
+			err:     ErrFeeCap,
+		},
+		{
+			name: "rejected by the node",
+			methods: rpcMethods{"eth_sendRawTransaction": func([]json.RawMessage) (any, error) {
+				return nil, errors.New("replacement transaction underpriced")
+			}},
+			err: errors.New("replacement transaction underpriced"),
+		},
+		{
+			name: "maybe sent",
+			methods: rpcMethods{"eth_sendRawTransaction": func([]json.RawMessage) (any, error) {
+				return nil, errGateway
+			}},
+			tip:    gwei(1.15),
+			feeCap: gwei(11.5),
+			gas:    100_000,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := newTxManager(key, from, config.NetworkConfig{ChainID: 1, MaxTxFee: c.maxFee})
+			f := fees{tip: gwei(1), feeCap: gwei(10)}
+			tx, err := m.sign(7, 100_000, ethereum.CallMsg{To: &to, Data: []byte{1, 2, 3}}, f)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			replacement, bumped, err := m.replace(context.Background(), stubRPC(t, c.methods), tx, f)
+			if c.err != nil {
+				if err == nil || (!errors.Is(err, c.err) && err.Error() != c.err.Error()) {
+					t.Fatalf("got error %v, want %v", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if bumped.tip.Cmp(c.tip) != 0 || bumped.feeCap.Cmp(c.feeCap) != 0 {
+				t.Errorf("got tip %s and fee cap %s, want %s and %s", bumped.tip, bumped.feeCap, c.tip, c.feeCap)
+			}
+			if replacement.Nonce() != tx.Nonce() || replacement.Gas() != c.gas || *replacement.To() != to {
+				t.Errorf("replacement is not the same transaction: nonce %d, gas %d, to %s", replacement.Nonce(), replacement.Gas(), replacement.To().Hex())
+			}
+			if replacement.GasTipCap().Cmp(c.tip) != 0 || replacement.GasFeeCap().Cmp(c.feeCap) != 0 {
+				t.Errorf("replacement was signed with tip %s and fee cap %s", replacement.GasTipCap(), replacement.GasFeeCap())
+			}
+		})
+	}
+}
+
+func TestTrySendNonce(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	to := common.HexToAddress("0x5FbDB2315678afecb367f032d93F642f64180aa3")
+
+	cases := []struct {
+		name      string
+		send      func([]json.RawMessage) (any, error)
+		err       bool
+		nonce     uint64
+		nonceSync bool
+	}{
+		{name: "accepted", send: func([]json.RawMessage) (any, error) { return common.Hash{}, nil }, nonce: 8, nonceSync: true},
+		{name: "already known", send: func([]json.RawMessage) (any, error) { return nil, errors.New("already known") }, nonce: 8, nonceSync: true},
+		{name: "maybe sent", send: func([]json.RawMessage) (any, error) { return nil, errGateway }, nonce: 8, nonceSync: true},
+		{name: "rejected", send: func([]json.RawMessage) (any, error) { return nil, errors.New("insufficient funds") }, err: true, nonce: 7, nonceSync: true},
+		{name: "nonce too low", send: func([]json.RawMessage) (any, error) { return nil, errors.New("nonce too low") }, err: true, nonce: 7},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rpcs := stubRPC(t, rpcMethods{
+				"eth_estimateGas":          func([]json.RawMessage) (any, error) { return hexutil.Uint64(50_000), nil },
+				"eth_getBlockByNumber":     latestHeader(gwei(5)),
+				"eth_maxPriorityFeePerGas": func([]json.RawMessage) (any, error) { return (*hexutil.Big)(gwei(1)), nil },
+				"eth_getTransactionCount":  func([]json.RawMessage) (any, error) { return hexutil.Uint64(7), nil },
+				"eth_sendRawTransaction":   c.send,
+			})
+
+			m := newTxManager(key, from, config.NetworkConfig{ChainID: 1})
+			tx, _, err := m.trySend(context.Background(), rpcs, ethereum.CallMsg{From: from, To: &to})
+			if (err != nil) != c.err {
+				t.Fatalf("got error %v, want one: %t", err, c.err)
+			}
+			if err == nil && (tx.Nonce() != 7 || tx.Gas() != 60_000) {
+				t.Errorf("sent with nonce %d and %d gas, want 7 and 60000", tx.Nonce(), tx.Gas())
+			}
+			if m.nonce != c.nonce || m.nonceSync != c.nonceSync {
+				t.Errorf("next nonce is %d (synced %t), want %d (synced %t)", m.nonce, m.nonceSync, c.nonce, c.nonceSync)
+			}
+		})
+	}
+}
@@ -1,18 +1,28 @@
 package relay
 
 import (
+	"sync/atomic"
+
 	"github.com/JackalLabs/mulberry/config"
 	"github.com/JackalLabs/mulberry/jackal/uploader"
 	"github.com/desmos-labs/cosmos-go-wallet/wallet"
+	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
-	hdwallet "github.com/miguelmota/go-ethereum-hdwallet"
 )
 
 type App struct {
-	w    *wallet.Wallet
-	wEth *hdwallet.Wallet
-	q    *uploader.Queue
-	cfg  config.Config
+	w      *wallet.Wallet
+	sender *evmSender
+	q      *uploader.Queue
+	cfg    config.Config
+	home   string
+	wal    *wal
+	coord  *coordinator
+
+	abis     map[string]abi.ABI
+	handlers []EventHandler
+	events   *eventRegistries
+	started  atomic.Bool
 }
 
 var ChainIDS = map[uint64]string{
@@ -0,0 +1,320 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// walState is how far a relayed message got
+type walState string
+
+const (
+	walQueued    walState = "queued"    // waiting in the Jackal queue
+	walBroadcast walState = "broadcast" // sent to Jackal in TxHash, the outcome is unknown
+	walCommitted walState = "committed" // executed on Jackal in TxHash, finishMessage is not sent yet
+	walFinished  walState = "finished"  // finished on the EVM side
+	walForgotten walState = "forgotten" // given up on, the event is a dead letter
+	walSkipped   walState = "skipped"   // no longer pending on the EVM side, refunded or finished by another relay
+)
+
+const (
+	// walRetention is how long finished and skipped messages are remembered, so a log fetched again can't be applied twice
+	walRetention = 7 * 24 * time.Hour
+	// walCompactEvery is the number of records appended before the file is rewritten with only the live entries
+	walCompactEvery = 10000
+)
+
+// walEntry is the state of the message relayed for one log
+type walEntry struct {
+	ID      string    `json:"id"`
+	ChainID uint64    `json:"chain_id"`
+	Log     types.Log `json:"log"`
+	// MessageID is the id the contract stored the message under, logs of one sender, event and block share it
+	MessageID string   `json:"message_id,omitempty"`
+	State     walState `json:"state"`
+	TxHash    string   `json:"tx_hash,omitempty"`
+	// FinishedIn is the EVM block the message was finished in, 0 if the contract had nothing to finish
+	FinishedIn uint64    `json:"finished_in,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// wal is the write-ahead log of relayed messages, kept in wal.jsonl under the home directory.
+// Every state change is appended before it is acted on, the last record of a message wins.
+// One process at a time holds it, through an exclusive lock on wal.lock.
+type wal struct {
+	mu      sync.Mutex
+	path    string
+	lock    *os.File
+	f       *os.File
+	entries map[string]*walEntry
+	appends int
+}
+
+// openWAL locks and loads the write-ahead log from the home directory and compacts it.
+// Only a record cut short at the end of the file is dropped, anything else that can't be read fails.
+func openWAL(homePath string) (*wal, error) {
+	w := wal{
+		path:    path.Join(homePath, "wal.jsonl"),
+		entries: make(map[string]*walEntry),
+	}
+
+	lockPath := path.Join(homePath, "wal.lock")
+	lock, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open write-ahead log lock at %s | %w", lockPath, err)
+	}
+	err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		_ = lock.Close()
+		return nil, fmt.Errorf("write-ahead log at %s is used by another mulberry process | %w", w.path, err)
+	}
+	w.lock = lock
+
+	err = w.load()
+	if err == nil {
+		err = w.compact()
+	}
+	if err != nil {
+		w.close()
+		return nil, err
+	}
+	return &w, nil
+}
+
+func (w *wal) load() error {
+	f, err := os.Open(w.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot open write-ahead log at %s | %w", w.path, err)
+	}
+	//nolint:errcheck
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("cannot read write-ahead log at %s | %w", w.path, err)
+		}
+		if len(bytes.TrimSpace(data)) > 0 {
+			var e walEntry
+			errParse := json.Unmarshal(data, &e)
+			if errParse == nil && len(e.ID) == 0 {
+				errParse = errors.New("record has no id")
+			}
+			if errParse != nil {
+				// a record without its newline is the last one and was cut short by a crash
+				if err == io.EOF {
+					log.Printf("Dropping the last record of %s, it was not fully written", w.path)
+					return nil
+				}
+				return fmt.Errorf("write-ahead log at %s is corrupt at line %d | %w", w.path, line, errParse)
+			}
+			w.entries[e.ID] = &e
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// close releases the write-ahead log for other processes
+func (w *wal) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.f != nil {
+		_ = w.f.Close()
+		w.f = nil
+	}
+	if w.lock != nil {
+		_ = syscall.Flock(int(w.lock.Fd()), syscall.LOCK_UN)
+		_ = w.lock.Close()
+		w.lock = nil
+	}
+}
+
+// lockWAL opens the write-ahead log for a command that relays, until unlockWAL. Other commands leave it alone.
+func (a *App) lockWAL() error {
+	journal, err := openWAL(a.home)
+	if err != nil {
+		return err
+	}
+	a.wal = journal
+	return nil
+}
+
+func (a *App) unlockWAL() {
+	if a.wal != nil {
+		a.wal.close()
+	}
+}
+
+// compact rewrites the log with only the entries that are still needed
+func (w *wal) compact() error {
+	for id, e := range w.entries {
+		if e.State == walForgotten || ((e.State == walFinished || e.State == walSkipped) && time.Since(e.Time) > walRetention) {
+			delete(w.entries, id)
+		}
+	}
+
+	tmp := w.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("cannot write write-ahead log at %s | %w", tmp, err)
+	}
+	for _, e := range w.entries {
+		err = writeRecord(f, e)
+		if err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	err = f.Sync()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, w.path)
+	if err != nil {
+		return fmt.Errorf("cannot replace write-ahead log at %s | %w", w.path, err)
+	}
+
+	if w.f != nil {
+		_ = w.f.Close()
+	}
+	w.f, err = os.OpenFile(w.path, os.O_APPEND|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("cannot open write-ahead log at %s | %w", w.path, err)
+	}
+	w.appends = 0
+	return nil
+}
+
+func writeRecord(f *os.File, e *walEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("cannot marshal write-ahead log entry | %w", err)
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err != nil {
+		return fmt.Errorf("cannot write write-ahead log entry | %w", err)
+	}
+	return nil
+}
+
+// get returns the entry of a log, the zero entry if it was never relayed
+func (w *wal) get(chainID uint64, l types.Log) walEntry {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	e, ok := w.entries[logID(chainID, l)]
+	if !ok {
+		return walEntry{}
+	}
+	return *e
+}
+
+// set records a new state for the message of a log and syncs it to disk
+func (w *wal) set(chainID uint64, l types.Log, messageID string, state walState, txHash string) error {
+	return w.write(walEntry{
+		ID:        logID(chainID, l),
+		ChainID:   chainID,
+		Log:       l,
+		MessageID: messageID,
+		State:     state,
+		TxHash:    txHash,
+		Time:      time.Now(),
+	})
+}
+
+// finish records that the message of a log was finished on the EVM side in a block, keeping its Jackal transaction
+func (w *wal) finish(chainID uint64, l types.Log, messageID string, block uint64) error {
+	return w.write(walEntry{
+		ID:         logID(chainID, l),
+		ChainID:    chainID,
+		Log:        l,
+		MessageID:  messageID,
+		State:      walFinished,
+		TxHash:     w.get(chainID, l).TxHash,
+		FinishedIn: block,
+		Time:       time.Now(),
+	})
+}
+
+// write appends an entry and syncs it to disk
+func (w *wal) write(e walEntry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := writeRecord(w.f, &e)
+	if err != nil {
+		return err
+	}
+	err = w.f.Sync()
+	if err != nil {
+		return fmt.Errorf("cannot sync write-ahead log | %w", err)
+	}
+	w.entries[e.ID] = &e
+
+	w.appends++
+	if w.appends >= walCompactEvery {
+		return w.compact()
+	}
+	return nil
+}
+
+// finishedIn returns the EVM block a log of a contract was finished in under a message ID, 0 if there is none.
+// finishMessage removes entries of the ID from the messages array that belong to the other logs that share it too,
+// those are still owed. It swaps the last entry into the one it removes and moves on, so an entry of the ID swapped
+// in survives: the entries left after it are not the ones that were pending.
+func (w *wal) finishedIn(chainID uint64, contract common.Address, messageID string) uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, e := range w.entries {
+		if e.ChainID == chainID && e.State == walFinished && e.FinishedIn > 0 && e.MessageID == messageID && e.Log.Address == contract {
+			return e.FinishedIn
+		}
+	}
+	return 0
+}
+
+// unfinished returns the logs of a network whose message was started but not finished, oldest first
+func (w *wal) unfinished(chainID uint64) []types.Log {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var logs []types.Log
+	for _, e := range w.entries {
+		if e.ChainID != chainID {
+			continue
+		}
+		switch e.State {
+		case walQueued, walBroadcast, walCommitted:
+			logs = append(logs, e.Log)
+		}
+	}
+	sort.Slice(logs, func(i, j int) bool { return logBefore(logs[i], logs[j]) })
+	return logs
+}
@@ -0,0 +1,175 @@
+package relay
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// walRecord returns the line of an entry for the log of sender at block
+func walRecord(t *testing.T, block uint64, state walState, at time.Time) string {
+	l := testLog(common.HexToAddress("0x1"), block, 0)
+	data, err := json.Marshal(walEntry{ID: logID(1, l), ChainID: 1, Log: l, State: state, Time: at})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data) + "\n"
+}
+
+func TestWALReplay(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-walRetention - time.Hour)
+
+	cases := []struct {
+		name   string
+		file   string
+		states map[uint64]walState // block of the log to its state after replay, missing blocks are not kept
+		err    bool
+	}{
+		{name: "no file"},
+		{
+			name:   "last record wins",
+			file:   walRecord(t, 1, walQueued, now) + walRecord(t, 1, walCommitted, now) + walRecord(t, 2, walQueued, now),
+			states: map[uint64]walState{1: walCommitted, 2: walQueued},
+		},
+		{
+			name:   "compacted",
+			file:   walRecord(t, 1, walForgotten, now) + walRecord(t, 2, walFinished, old) + walRecord(t, 3, walSkipped, old) + walRecord(t, 4, walFinished, now) + walRecord(t, 5, walBroadcast, old),
+			states: map[uint64]walState{4: walFinished, 5: walBroadcast},
+		},
+		{
+			name:   "last record cut short",
+			file:   walRecord(t, 1, walQueued, now) + strings.TrimSuffix(walRecord(t, 2, walQueued, now), "\n")[:40],
+			states: map[uint64]walState{1: walQueued},
+		},
+		{
+			name: "corrupt record before the end",
+			file: walRecord(t, 1, walQueued, now)[:40] + "\n" + walRecord(t, 2, walQueued, now),
+			err:  true,
+		},
+		{
+			name: "record without id",
+			file: `{"chain_id":1,"state":"queued"}` + "\n" + walRecord(t, 2, walQueued, now),
+			err:  true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			home := t.TempDir()
+			if len(c.file) > 0 {
+				err := os.WriteFile(path.Join(home, "wal.jsonl"), []byte(c.file), 0o644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			w, err := openWAL(home)
+			if (err != nil) != c.err {
+				t.Fatalf("got error %v, want one: %t", err, c.err)
+			}
+			if err != nil {
+				return
+			}
+			defer w.close()
+
+			if len(w.entries) != len(c.states) {
+				t.Errorf("replayed %d entries, want %d", len(w.entries), len(c.states))
+			}
+			for block, state := range c.states {
+				e := w.get(1, testLog(common.HexToAddress("0x1"), block, 0))
+				if e.State != state {
+					t.Errorf("log in block %d is %q, want %q", block, e.State, state)
+				}
+			}
+
+			// the file holds the live entries only, one record each
+			lines := walLines(t, home)
+			if lines != len(c.states) {
+				t.Errorf("compacted file has %d records, want %d", lines, len(c.states))
+			}
+		})
+	}
+}
+
+func TestWALCompactsWhileRunning(t *testing.T) {
+	home := t.TempDir()
+	w, err := openWAL(home)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.close()
+
+	l := testLog(common.HexToAddress("0x1"), 1, 0)
+	for i := 0; i < walCompactEvery; i++ {
+		err = w.set(1, l, "message", walQueued, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lines := walLines(t, home); lines != 1 {
+		t.Fatalf("file has %d records after compaction, want 1", lines)
+	}
+
+	// appending goes on in the compacted file
+	err = w.set(1, l, "message", walCommitted, "TX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.close()
+
+	w, err = openWAL(home)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.close()
+	if e := w.get(1, l); e.State != walCommitted || e.TxHash != "TX" || e.MessageID != "message" {
+		t.Errorf("replayed %+v", e)
+	}
+}
+
+func TestWALLock(t *testing.T) {
+	home := t.TempDir()
+	w, err := openWAL(home)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = openWAL(home)
+	if err == nil {
+		t.Fatal("opened the write-ahead log twice")
+	}
+
+	w.close()
+	w, err = openWAL(home)
+	if err != nil {
+		t.Fatalf("cannot open the write-ahead log once it was closed: %v", err)
+	}
+	w.close()
+}
+
+// walLines counts the records in the write-ahead log of home
+func walLines(t *testing.T, home string) int {
+	f, err := os.Open(path.Join(home, "wal.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//nolint:errcheck
+	defer f.Close()
+
+	lines := 0
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		lines++
+	}
+	if s.Err() != nil {
+		t.Fatal(s.Err())
+	}
+	return lines
+}
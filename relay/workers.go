@@ -0,0 +1,172 @@
+package relay
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+const (
+	defaultWorkers    = 8
+	defaultMaxPending = 1000
+)
+
+// logPool runs the relay work for one network on a fixed number of workers.
+// Logs from the same sender are run one at a time in (block, log index) order,
+// and submit blocks once maxPending logs are queued or in flight.
+type logPool struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	senders    map[common.Address]*senderQueue
+	ready      []common.Address
+	pending    int
+	maxPending int
+	running    int
+	closed     bool
+	workers    sync.WaitGroup
+	work       func(types.Log)
+}
+
+// senderQueue holds the logs waiting for one sender
+type senderQueue struct {
+	logs    []types.Log
+	running bool
+}
+
+func newLogPool(workers int, maxPending int, work func(types.Log)) *logPool {
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	if maxPending <= 0 {
+		maxPending = defaultMaxPending
+	}
+
+	p := logPool{
+		senders:    make(map[common.Address]*senderQueue),
+		maxPending: maxPending,
+		work:       work,
+	}
+	p.cond = sync.NewCond(&p.mu)
+
+	p.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+
+	return &p
+}
+
+// submit queues a log behind the other logs of its sender, waiting while the pool is full.
+// Logs submitted after close are ignored, they are still held by the checkpoint.
+func (p *logPool) submit(l types.Log) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.pending >= p.maxPending && !p.closed {
+		p.cond.Wait()
+	}
+	if p.closed {
+		return
+	}
+	p.pending++
+
+	from := logSender(l)
+	q, ok := p.senders[from]
+	if !ok {
+		q = &senderQueue{}
+		p.senders[from] = q
+	}
+
+	i := sort.Search(len(q.logs), func(i int) bool {
+		return logBefore(l, q.logs[i])
+	})
+	q.logs = append(q.logs, types.Log{})
+	copy(q.logs[i+1:], q.logs[i:])
+	q.logs[i] = l
+
+	if !q.running && len(q.logs) == 1 {
+		p.ready = append(p.ready, from)
+	}
+	p.cond.Broadcast()
+}
+
+// close stops the workers from starting queued logs, logs already being worked on are finished
+func (p *logPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.cond.Broadcast()
+}
+
+// wait blocks until every worker has exited after close or ctx is done, returning the number of logs still in flight
+func (p *logPool) wait(ctx context.Context) (int, error) {
+	done := make(chan struct{})
+	go func() {
+		p.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return 0, nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.running, ctx.Err()
+	}
+}
+
+func (p *logPool) worker() {
+	defer p.workers.Done()
+	for {
+		p.mu.Lock()
+		for len(p.ready) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+		if p.closed {
+			p.mu.Unlock()
+			return
+		}
+		from := p.ready[0]
+		p.ready = p.ready[1:]
+
+		q := p.senders[from]
+		l := q.logs[0]
+		q.logs = q.logs[1:]
+		q.running = true
+		p.running++
+		p.mu.Unlock()
+
+		p.work(l)
+
+		p.mu.Lock()
+		q.running = false
+		p.running--
+		p.pending--
+		if len(q.logs) > 0 {
+			p.ready = append(p.ready, from)
+		} else {
+			delete(p.senders, from)
+		}
+		p.cond.Broadcast()
+		p.mu.Unlock()
+	}
+}
+
+// logSender returns the EVM address a log was emitted for, every bridge event starts with a non-indexed `address from`
+func logSender(l types.Log) common.Address {
+	if len(l.Data) < 32 {
+		return common.Address{}
+	}
+	return common.BytesToAddress(l.Data[12:32])
+}
+
+func logBefore(a types.Log, b types.Log) bool {
+	if a.BlockNumber != b.BlockNumber {
+		return a.BlockNumber < b.BlockNumber
+	}
+	return a.Index < b.Index
+}
@@ -0,0 +1,203 @@
+package relay
+
+import (
+	"context"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// testLog returns a log of sender at block and index, with hashes that tell it apart from every other
+func testLog(sender common.Address, block uint64, index uint) types.Log {
+	data := make([]byte, 64)
+	copy(data[12:32], sender.Bytes())
+	return types.Log{
+		Topics:      []common.Hash{crypto.Keccak256Hash([]byte("PostedFile(address,string,string,uint64,uint64,string)"))},
+		Data:        data,
+		BlockNumber: block,
+		BlockHash:   common.BigToHash(new(big.Int).SetUint64(block)),
+		TxHash:      crypto.Keccak256Hash(sender.Bytes(), common.BigToHash(new(big.Int).SetUint64(block)).Bytes(), []byte{byte(index)}),
+		Index:       index,
+	}
+}
+
+func TestLogPoolSenderOrder(t *testing.T) {
+	alice := common.HexToAddress("0xa1")
+	bob := common.HexToAddress("0xb0")
+
+	cases := []struct {
+		name    string
+		workers int
+		logs    []types.Log
+	}{
+		{
+			name:    "one worker",
+			workers: 1,
+			logs:    []types.Log{testLog(alice, 9, 0), testLog(bob, 4, 1), testLog(alice, 3, 2), testLog(alice, 3, 0), testLog(bob, 2, 0)},
+		},
+		{
+			name:    "more workers than senders",
+			workers: 4,
+			logs:    []types.Log{testLog(alice, 9, 0), testLog(bob, 4, 1), testLog(alice, 3, 2), testLog(alice, 3, 0), testLog(bob, 2, 0), testLog(bob, 2, 3)},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var mu sync.Mutex
+			running := make(map[common.Address]bool)
+			done := make(map[common.Address][]types.Log)
+			release := make(chan struct{})
+			var wg sync.WaitGroup
+			first := []types.Log{testLog(alice, 1, 0), testLog(bob, 1, 0)}
+			wg.Add(len(first) + len(c.logs))
+
+			p := newLogPool(c.workers, 100, func(l types.Log) {
+				defer wg.Done()
+				<-release
+
+				from := logSender(l)
+				mu.Lock()
+				if running[from] {
+					t.Errorf("two logs of %s ran at once", from.Hex())
+				}
+				running[from] = true
+				mu.Unlock()
+
+				time.Sleep(time.Millisecond)
+
+				mu.Lock()
+				running[from] = false
+				done[from] = append(done[from], l)
+				mu.Unlock()
+			})
+
+			// the first log of each sender holds it while the rest are queued out of order behind it
+			for _, l := range first {
+				p.submit(l)
+			}
+			for _, l := range c.logs {
+				p.submit(l)
+			}
+			close(release)
+			wg.Wait()
+			p.close()
+			_, err := p.wait(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			total := 0
+			for from, logs := range done {
+				total += len(logs)
+				for i := 1; i < len(logs); i++ {
+					if !logBefore(logs[i-1], logs[i]) {
+						t.Errorf("logs of %s ran out of order: block %d index %d before block %d index %d",
+							from.Hex(), logs[i-1].BlockNumber, logs[i-1].Index, logs[i].BlockNumber, logs[i].Index)
+					}
+				}
+			}
+			if total != len(first)+len(c.logs) {
+				t.Errorf("ran %d logs, want %d", total, len(first)+len(c.logs))
+			}
+		})
+	}
+}
+
+func TestLogPoolBackpressure(t *testing.T) {
+	cases := []struct {
+		name       string
+		workers    int
+		maxPending int
+	}{
+		{name: "queued behind one sender", workers: 2, maxPending: 2},
+		{name: "every worker busy", workers: 1, maxPending: 3},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			release := make(chan struct{})
+			p := newLogPool(c.workers, c.maxPending, func(types.Log) { <-release })
+
+			sender := common.HexToAddress("0x1")
+			for i := 0; i < c.maxPending; i++ {
+				p.submit(testLog(sender, uint64(i+1), 0))
+			}
+
+			submitted := make(chan struct{})
+			go func() {
+				p.submit(testLog(sender, uint64(c.maxPending+1), 0))
+				close(submitted)
+			}()
+
+			select {
+			case <-submitted:
+				t.Fatalf("submit returned with %d logs pending", c.maxPending)
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			release <- struct{}{}
+			select {
+			case <-submitted:
+			case <-time.After(time.Second):
+				t.Fatal("submit still blocked after a log finished")
+			}
+
+			close(release)
+			p.close()
+			_, err := p.wait(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestLogPoolClose(t *testing.T) {
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	ran := make(chan types.Log, 10)
+	p := newLogPool(1, 1, func(l types.Log) {
+		started <- struct{}{}
+		<-release
+		ran <- l
+	})
+
+	sender := common.HexToAddress("0x1")
+	p.submit(testLog(sender, 1, 0))
+	<-started
+
+	blocked := make(chan struct{})
+	go func() {
+		p.submit(testLog(sender, 2, 0))
+		close(blocked)
+	}()
+
+	p.close()
+	select {
+	case <-blocked:
+	case <-time.After(time.Second):
+		t.Fatal("close did not release a blocked submit")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	inFlight, err := p.wait(ctx)
+	if err == nil || inFlight != 1 {
+		t.Errorf("got %d in flight (%v), want the running log", inFlight, err)
+	}
+
+	close(release)
+	_, err = p.wait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ran) != 1 {
+		t.Errorf("ran %d logs after close, want only the one in flight", len(ran))
+	}
+}